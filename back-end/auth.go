@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// jwtLeeway is the clock skew tolerated on the exp and nbf claims.
+const jwtLeeway = 30 * time.Second
+
+var (
+	errNoCredentials  = errors.New("no credentials")
+	errInvalidAPIKey  = errors.New("invalid api key")
+	errInvalidToken   = errors.New("invalid token")
+	errExpiredToken   = errors.New("token expired")
+	errUnknownSignKey = errors.New("unknown signing key")
+)
+
+// identity is the authenticated caller of the API.
+type identity struct {
+	ID     string
+	Role   string
+	Method string
+}
+
+type identityCtx struct{}
+
+// identityFromContext returns the caller authenticated by authenticated.
+func identityFromContext(ctx context.Context) (identity, bool) {
+	ident, ok := ctx.Value(identityCtx{}).(identity)
+	return ident, ok
+}
+
+// authenticator checks the API keys and JWT bearer tokens of the callers.
+// API keys are configured with API_KEYS as "key=id:role" pairs separated by
+// commas. Tokens must be signed by a key of the JWKS file at JWKS_FILE
+// (RS256 or ES256), and match JWT_ISSUER and JWT_AUDIENCE when they are set.
+type authenticator struct {
+	apiKeys  map[string]identity
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+func newAuthenticator() (*authenticator, error) {
+	a := &authenticator{
+		apiKeys:  make(map[string]identity),
+		keys:     make(map[string]crypto.PublicKey),
+		issuer:   getenv("JWT_ISSUER", ""),
+		audience: getenv("JWT_AUDIENCE", ""),
+		now:      time.Now,
+	}
+
+	for _, entry := range strings.Split(getenv("API_KEYS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid API_KEYS entry %q, expected key=id:role", entry)
+		}
+		id := strings.SplitN(parts[1], ":", 2)
+		ident := identity{ID: id[0], Method: "api-key"}
+		if len(id) == 2 {
+			ident.Role = id[1]
+		}
+		a.apiKeys[parts[0]] = ident
+	}
+
+	if path := getenv("JWKS_FILE", ""); path != "" {
+		if err := a.loadJWKS(path); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+	}
+
+	if len(a.apiKeys) == 0 && len(a.keys) == 0 {
+		logger.Println("Neither API_KEYS nor JWKS_FILE is set, every checkout will be rejected")
+	}
+	return a, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *authenticator) loadJWKS(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			if k.Alg != "" && k.Alg != "RS256" {
+				return fmt.Errorf("unsupported algorithm %q of RSA key %q", k.Alg, k.Kid)
+			}
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			a.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Alg != "" && k.Alg != "ES256" {
+				return fmt.Errorf("unsupported algorithm %q of EC key %q", k.Alg, k.Kid)
+			}
+			if k.Crv != "P-256" {
+				return fmt.Errorf("unsupported curve %q of key %q", k.Crv, k.Kid)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			a.keys[k.Kid] = pub
+		}
+	}
+	return nil
+}
+
+// authenticate returns the identity of the caller of req.
+func (a *authenticator) authenticate(req *http.Request) (identity, error) {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		for k, ident := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				return ident, nil
+			}
+		}
+		return identity{}, errInvalidAPIKey
+	}
+
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return a.verifyToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	return identity{}, errNoCredentials
+}
+
+// verifyToken checks the signature and the claims of a compact JWS.
+func (a *authenticator) verifyToken(token string) (identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return identity{}, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return identity{}, errInvalidToken
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok {
+		return identity{}, errUnknownSignKey
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return identity{}, errInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// the algorithm must match the type of the key, so a token can not pick a
+	// weaker check than the key was published for
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return identity{}, errInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return identity{}, errInvalidToken
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return identity{}, errInvalidToken
+		}
+	default:
+		return identity{}, errUnknownSignKey
+	}
+
+	var claims struct {
+		Sub  string          `json:"sub"`
+		Role string          `json:"role"`
+		Iss  string          `json:"iss"`
+		Aud  json.RawMessage `json:"aud"`
+		Exp  int64           `json:"exp"`
+		Nbf  int64           `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Sub == "" {
+		return identity{}, errInvalidToken
+	}
+
+	now := a.now()
+	if claims.Exp == 0 || now.After(time.Unix(claims.Exp, 0).Add(jwtLeeway)) {
+		return identity{}, errExpiredToken
+	}
+	if claims.Nbf != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.Nbf, 0)) {
+		return identity{}, errInvalidToken
+	}
+	if a.issuer != "" && claims.Iss != a.issuer {
+		return identity{}, errInvalidToken
+	}
+	if a.audience != "" && !hasAudience(claims.Aud, a.audience) {
+		return identity{}, errInvalidToken
+	}
+
+	return identity{ID: claims.Sub, Role: claims.Role, Method: "jwt"}, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether the aud claim, a string or a list of strings,
+// contains audience.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticated rejects the requests without valid credentials with 401. The
+// identity of the others is set on the server span and put in the baggage, so
+// it reaches the spans of every downstream service as well.
+func authenticated(auth *authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+
+		ident, err := auth.authenticate(req)
+		if err != nil {
+			span.SetStatus(codes.Error, "unauthenticated")
+			span.AddEvent("Authentication failed", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="checkout"`)
+			http.Error(w, "unauthenticated: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		span.SetAttributes(
+			semconv.EnduserIDKey.String(ident.ID),
+			attribute.String("enduser.auth_method", ident.Method),
+		)
+		if ident.Role != "" {
+			span.SetAttributes(semconv.EnduserRoleKey.String(ident.Role))
+		}
+
+		// the enduser members of the incoming baggage are the caller's claims,
+		// only the verified identity may reach the downstream services
+		bag := baggage.FromContext(ctx)
+		for _, m := range bag.Members() {
+			if strings.HasPrefix(m.Key(), "enduser.") {
+				bag = bag.DeleteMember(m.Key())
+			}
+		}
+		// escaped since the baggage only allows a restricted set of characters
+		if m, err := baggage.NewMember(common.BaggageEnduserID, url.QueryEscape(ident.ID)); err == nil {
+			bag, _ = bag.SetMember(m)
+		}
+		if m, err := baggage.NewMember(common.BaggageEnduserRole, url.QueryEscape(ident.Role)); err == nil && ident.Role != "" {
+			bag, _ = bag.SetMember(m)
+		}
+
+		ctx = context.WithValue(baggage.ContextWithBaggage(ctx, bag), identityCtx{}, ident)
+		// an Idempotency-Key only stands for the requests of its client
+		ctx = common.WithIdempotencyScope(ctx, ident.Method+":"+ident.ID)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// writeJWKS writes the keys as a JWKS file and returns its path.
+func writeJWKS(t *testing.T, keys ...jwk) string {
+	t.Helper()
+	data, err := json.Marshal(map[string][]jwk{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func rsaJWK(kid string, pub *rsa.PublicKey) jwk {
+	return jwk{Kid: kid, Kty: "RSA", Alg: "RS256", Use: "sig", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}
+}
+
+func ecJWK(kid string, pub *ecdsa.PublicKey) jwk {
+	return jwk{Kid: kid, Kty: "EC", Alg: "ES256", Use: "sig", Crv: "P-256", X: b64(pub.X.FillBytes(make([]byte, 32))), Y: b64(pub.Y.FillBytes(make([]byte, 32)))}
+}
+
+// sign returns a compact JWS of claims, signed with key as alg claims to be.
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(sig)
+}
+
+func testAuthenticator(t *testing.T) (*authenticator, *rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &authenticator{
+		apiKeys:  make(map[string]identity),
+		keys:     make(map[string]crypto.PublicKey),
+		issuer:   "https://auth.example.com",
+		audience: "checkout",
+		now:      func() time.Time { return testNow },
+	}
+	if err := a.loadJWKS(writeJWKS(t, rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey))); err != nil {
+		t.Fatal(err)
+	}
+	return a, rsaKey, ecKey
+}
+
+func TestVerifyToken(t *testing.T) {
+	a, rsaKey, ecKey := testAuthenticator(t)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":  "arman",
+			"role": "customer",
+			"iss":  "https://auth.example.com",
+			"aud":  "checkout",
+			"exp":  testNow.Add(time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"rs256", sign(t, "RS256", "rsa", rsaKey, claims(nil)), nil},
+		{"es256", sign(t, "ES256", "ec", ecKey, claims(nil)), nil},
+		{"audience list", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": []string{"other", "checkout"}})), nil},
+		{"expired within leeway", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": testNow.Add(-jwtLeeway / 2).Unix()})), nil},
+		{"not yet valid within leeway", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"nbf": testNow.Add(jwtLeeway / 2).Unix()})), nil},
+
+		{"rs256 header on an EC key", sign(t, "RS256", "ec", ecKey, claims(nil)), errInvalidToken},
+		{"es256 header on an RSA key", sign(t, "ES256", "rsa", rsaKey, claims(nil)), errInvalidToken},
+		{"none algorithm", sign(t, "none", "rsa", rsaKey, claims(nil)), errInvalidToken},
+		{"signed by another key", sign(t, "ES256", "ec", otherKey, claims(nil)), errInvalidToken},
+		{"unknown kid", sign(t, "ES256", "other", ecKey, claims(nil)), errUnknownSignKey},
+		{"expired", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": testNow.Add(-time.Hour).Unix()})), errExpiredToken},
+		{"without exp", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": nil})), errExpiredToken},
+		{"not yet valid", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"nbf": testNow.Add(time.Hour).Unix()})), errInvalidToken},
+		{"wrong audience", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": "admin"})), errInvalidToken},
+		{"wrong audience list", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": []string{"admin"}})), errInvalidToken},
+		{"without audience", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": nil})), errInvalidToken},
+		{"wrong issuer", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), errInvalidToken},
+		{"without subject", sign(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"sub": nil})), errInvalidToken},
+		{"not a jws", "abc.def", errInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ident, err := a.verifyToken(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("verifyToken() error = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && (ident.ID != "arman" || ident.Role != "customer" || ident.Method != "jwt") {
+				t.Errorf("verifyToken() = %+v", ident)
+			}
+		})
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	withAlg := func(k jwk, alg string) jwk { k.Alg = alg; return k }
+	offCurve := ecJWK("ec", &ecKey.PublicKey)
+	offCurve.Y = b64(new(big.Int).Add(ecKey.Y, big.NewInt(1)).Bytes())
+	p384 := ecJWK("ec", &ecKey.PublicKey)
+	p384.Crv = "P-384"
+	encryption := rsaJWK("enc", &rsaKey.PublicKey)
+	encryption.Use = "enc"
+
+	tests := []struct {
+		name    string
+		keys    []jwk
+		wantErr bool
+		kids    []string
+	}{
+		{"rsa and ec", []jwk{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}, false, []string{"rsa", "ec"}},
+		{"without alg", []jwk{withAlg(rsaJWK("rsa", &rsaKey.PublicKey), "")}, false, []string{"rsa"}},
+		{"encryption keys are skipped", []jwk{encryption}, false, nil},
+		{"es256 on an RSA key", []jwk{withAlg(rsaJWK("rsa", &rsaKey.PublicKey), "ES256")}, true, nil},
+		{"rs256 on an EC key", []jwk{withAlg(ecJWK("ec", &ecKey.PublicKey), "RS256")}, true, nil},
+		{"hs256", []jwk{withAlg(rsaJWK("rsa", &rsaKey.PublicKey), "HS256")}, true, nil},
+		{"unsupported curve", []jwk{p384}, true, nil},
+		{"point off the curve", []jwk{offCurve}, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &authenticator{keys: make(map[string]crypto.PublicKey)}
+			err := a.loadJWKS(writeJWKS(t, tt.keys...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadJWKS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(a.keys) != len(tt.kids) {
+				t.Errorf("loadJWKS() loaded %d keys, want %d", len(a.keys), len(tt.kids))
+			}
+			for _, kid := range tt.kids {
+				if _, ok := a.keys[kid]; !ok {
+					t.Errorf("loadJWKS() did not load key %q", kid)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticatedReplacesEnduserBaggage(t *testing.T) {
+	a := &authenticator{apiKeys: map[string]identity{"sk_test": {ID: "arman", Method: "api-key"}}}
+
+	var bag baggage.Baggage
+	handler := authenticated(a, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bag = baggage.FromContext(req.Context())
+	}))
+
+	req := httptest.NewRequest("POST", "/checkout", nil)
+	req.Header.Set(apiKeyHeader, "sk_test")
+	forged, _ := baggage.Parse("enduser.id=admin,enduser.role=admin,enduser.scope=all,cart=42")
+	req = req.WithContext(baggage.ContextWithBaggage(req.Context(), forged))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := bag.Member(common.BaggageEnduserID).Value(); got != "arman" {
+		t.Errorf("enduser.id = %q, want arman", got)
+	}
+	for _, key := range []string{common.BaggageEnduserRole, "enduser.scope"} {
+		if got := bag.Member(key).Value(); got != "" {
+			t.Errorf("%s = %q, want it dropped", key, got)
+		}
+	}
+	if got := bag.Member("cart").Value(); got != "42" {
+		t.Errorf("cart = %q, the other members must be kept", got)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "fmt"
+
+// Card is only passed through to the payment-gateway. It must never be
+// logged as is, String masks everything but the last four digits.
+type Card struct {
+	Number string `json:"number"`
+	Expiry string `json:"expiry"`
+	CVV    string `json:"cvv"`
+}
+
+func (c Card) String() string {
+	last4 := c.Number
+	if len(last4) > 4 {
+		last4 = last4[len(last4)-4:]
+	}
+	return fmt.Sprintf("{last4:%s expiry:%s}", last4, c.Expiry)
+}
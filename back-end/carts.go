@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cartTTL is how long a cart nobody touched is kept, and cartIdleTTL how long
+// an open one, which was most likely abandoned by then.
+const (
+	cartTTL     = 24 * time.Hour
+	cartIdleTTL = 2 * time.Hour
+)
+
+// maxCartQuantity bounds the quantity of one item of a cart, maxCartItems
+// the number of different items.
+const (
+	maxCartQuantity = 100
+	maxCartItems    = 50
+)
+
+// maxOpenCarts bounds the carts a client has not checked out yet, so one
+// client can not fill the memory of the back-end with carts.
+const maxOpenCarts = 20
+
+const (
+	cartOpen        = "open"
+	cartCheckingOut = "checking-out"
+	cartCheckedOut  = "checked-out"
+)
+
+var (
+	errCartNotFound  = errors.New("cart not found")
+	errCartNotOpen   = errors.New("cart is not open")
+	errCartEmpty     = errors.New("cart is empty")
+	errInvalidCartOp = errors.New("invalid cart item")
+	errTooManyCarts  = fmt.Errorf("more than %d carts which are not checked out", maxOpenCarts)
+)
+
+type cartItem struct {
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+}
+
+// cart is a basket filled over several requests and checked out with its id.
+type cart struct {
+	ID        string     `json:"cart-id"`
+	Status    string     `json:"status"`
+	Items     []cartItem `json:"items"`
+	OrderID   string     `json:"order-id,omitempty"`
+	CreatedAt time.Time  `json:"created-at"`
+	UpdatedAt time.Time  `json:"updated-at"`
+
+	// the client the cart belongs to, nobody else sees it
+	owner string
+	// the span which created the cart, every later request on it links back
+	// to it so a shopping session can be followed across its traces
+	created trace.SpanContext
+}
+
+// basket lists every item as often as its quantity, as an Order has it.
+func (c cart) basket() []string {
+	var basket []string
+	for _, i := range c.Items {
+		for n := 0; n < i.Quantity; n++ {
+			basket = append(basket, i.Item)
+		}
+	}
+	return basket
+}
+
+type cartStore struct {
+	mu    sync.Mutex
+	carts map[string]*cart
+}
+
+func newCartStore() *cartStore {
+	return &cartStore{carts: make(map[string]*cart)}
+}
+
+func (s *cartStore) create(owner string, created trace.SpanContext) (cart, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return cart{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	open := 0
+	for id, c := range s.carts {
+		idle := now.Sub(c.UpdatedAt)
+		if idle > cartTTL || (c.Status == cartOpen && idle > cartIdleTTL) {
+			delete(s.carts, id)
+		} else if c.owner == owner && c.Status != cartCheckedOut {
+			open++
+		}
+	}
+	if open >= maxOpenCarts {
+		return cart{}, errTooManyCarts
+	}
+
+	c := &cart{
+		ID:        "CART-" + hex.EncodeToString(b),
+		Status:    cartOpen,
+		Items:     []cartItem{},
+		CreatedAt: now,
+		UpdatedAt: now,
+		owner:     owner,
+		created:   created,
+	}
+	s.carts[c.ID] = c
+	return *c, nil
+}
+
+// get returns the cart id of owner. The carts of the other clients are not
+// found, rather than forbidden, so their ids cannot be probed.
+func (s *cartStore) get(id, owner string) (cart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.lookup(id, owner)
+	if err != nil {
+		return cart{}, err
+	}
+	return s.copy(c), nil
+}
+
+// setQuantity sets the quantity of item, adding it to the cart or, with 0,
+// removing it. With add the quantity is added to the one in the cart.
+func (s *cartStore) setQuantity(id, owner, item string, quantity int, add bool) (cart, error) {
+	if item == "" || quantity < 0 {
+		return cart{}, errInvalidCartOp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.lookup(id, owner)
+	if err != nil {
+		return cart{}, err
+	}
+	if c.Status != cartOpen {
+		return s.copy(c), errCartNotOpen
+	}
+
+	i := 0
+	for ; i < len(c.Items) && c.Items[i].Item != item; i++ {
+	}
+	if add && i < len(c.Items) {
+		quantity += c.Items[i].Quantity
+	}
+	if quantity > maxCartQuantity {
+		return s.copy(c), fmt.Errorf("%w: at most %d of an item", errInvalidCartOp, maxCartQuantity)
+	}
+	if i == len(c.Items) && quantity > 0 && len(c.Items) >= maxCartItems {
+		return s.copy(c), fmt.Errorf("%w: at most %d different items", errInvalidCartOp, maxCartItems)
+	}
+
+	switch {
+	case i == len(c.Items) && quantity > 0:
+		c.Items = append(c.Items, cartItem{Item: item, Quantity: quantity})
+	case i < len(c.Items) && quantity > 0:
+		c.Items[i].Quantity = quantity
+	case i < len(c.Items):
+		c.Items = append(c.Items[:i], c.Items[i+1:]...)
+	}
+	c.UpdatedAt = time.Now().UTC()
+	return s.copy(c), nil
+}
+
+// remove deletes the cart id of owner, unless it is being checked out.
+func (s *cartStore) remove(id, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.lookup(id, owner)
+	if err != nil {
+		return err
+	}
+	if c.Status == cartCheckingOut {
+		return errCartNotOpen
+	}
+	delete(s.carts, id)
+	return nil
+}
+
+// beginCheckout locks the cart for a checkout, so it can neither be changed
+// nor checked out a second time meanwhile.
+func (s *cartStore) beginCheckout(id, owner string) (cart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.lookup(id, owner)
+	if err != nil {
+		return cart{}, err
+	}
+	if c.Status != cartOpen {
+		return s.copy(c), errCartNotOpen
+	}
+	if len(c.Items) == 0 {
+		return s.copy(c), errCartEmpty
+	}
+	c.Status = cartCheckingOut
+	c.UpdatedAt = time.Now().UTC()
+	return s.copy(c), nil
+}
+
+// endCheckout closes the cart with the order it became, or opens it again if
+// the checkout failed and orderID is empty.
+func (s *cartStore) endCheckout(id, orderID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.carts[id]
+	if !ok {
+		return
+	}
+	c.Status = cartOpen
+	if orderID != "" {
+		c.Status = cartCheckedOut
+		c.OrderID = orderID
+	}
+	c.UpdatedAt = time.Now().UTC()
+}
+
+// lookup returns the cart id of owner. s.mu must be held.
+func (s *cartStore) lookup(id, owner string) (*cart, error) {
+	c, ok := s.carts[id]
+	if !ok || c.owner != owner {
+		return nil, errCartNotFound
+	}
+	return c, nil
+}
+
+// copy returns a copy of c which does not share its items. s.mu must be held.
+func (s *cartStore) copy(c *cart) cart {
+	cp := *c
+	cp.Items = append([]cartItem{}, c.Items...)
+	return cp
+}
+
+// cartErrorStatus maps cart store errors to HTTP status codes.
+func cartErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCartNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errCartNotOpen), errors.Is(err, errCartEmpty):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidCartOp):
+		return http.StatusBadRequest
+	case errors.Is(err, errTooManyCarts):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// cartSpan starts the span of an operation on the cart id, linked to the span
+// which created the cart.
+func cartSpan(req *http.Request, carts *cartStore, name, id string) (trace.Span, error) {
+	owner, _ := clientOf(req)
+	c, err := carts.get(id, owner)
+	opts := []trace.SpanStartOption{trace.WithAttributes(attribute.String("cart.id", id))}
+	if err == nil {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: c.created}))
+	}
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("cart.id", id))
+	_, span := tracer.Start(req.Context(), name, opts...)
+	return span, err
+}
+
+// cartsHandler serves the cart API:
+//
+//	POST   /carts                    creates a cart
+//	GET    /carts/{id}               returns the cart
+//	DELETE /carts/{id}               deletes the cart
+//	POST   /carts/{id}/items         adds {"item", "quantity"} to it
+//	PUT    /carts/{id}/items/{item}  sets the quantity of the item to {"quantity"}
+//	DELETE /carts/{id}/items/{item}  removes the item
+func cartsHandler(carts *cartStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		owner, _ := clientOf(req)
+		parts := strings.SplitN(strings.Trim(strings.TrimPrefix(req.URL.EscapedPath(), "/carts"), "/"), "/", 3)
+
+		switch {
+		case parts[0] == "" && req.Method == http.MethodPost:
+			_, span := tracer.Start(req.Context(), "create-cart")
+			c, err := carts.create(owner, span.SpanContext())
+			if err == nil {
+				span.SetAttributes(attribute.String("cart.id", c.ID))
+				trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("cart.id", c.ID))
+			}
+			span.End()
+			writeCart(w, c, err, http.StatusCreated)
+
+		case len(parts) == 1 && parts[0] != "" && req.Method == http.MethodGet:
+			span, _ := cartSpan(req, carts, "get-cart", parts[0])
+			span.End()
+			c, err := carts.get(parts[0], owner)
+			writeCart(w, c, err, http.StatusOK)
+
+		case len(parts) == 1 && parts[0] != "" && req.Method == http.MethodDelete:
+			span, _ := cartSpan(req, carts, "delete-cart", parts[0])
+			err := carts.remove(parts[0], owner)
+			if err != nil {
+				span.AddEvent("Error deleting cart", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			}
+			span.End()
+			if err != nil {
+				http.Error(w, err.Error(), cartErrorStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case len(parts) >= 2 && parts[1] == "items":
+			var body cartItem
+			if req.Method != http.MethodDelete {
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			add := false
+			switch {
+			case len(parts) == 2 && req.Method == http.MethodPost:
+				add = true
+				if body.Quantity == 0 {
+					body.Quantity = 1
+				}
+			case len(parts) == 3 && (req.Method == http.MethodPut || req.Method == http.MethodDelete):
+				item, err := url.PathUnescape(parts[2])
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body.Item = item
+				if req.Method == http.MethodDelete {
+					body.Quantity = 0
+				}
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			span, _ := cartSpan(req, carts, "update-cart", parts[0])
+			span.SetAttributes(attribute.String("cart.item", body.Item), attribute.Int("cart.quantity", body.Quantity))
+			c, err := carts.setQuantity(parts[0], owner, body.Item, body.Quantity, add)
+			if err != nil {
+				span.AddEvent("Error updating cart", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			}
+			span.End()
+			writeCart(w, c, err, http.StatusOK)
+
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
+
+func writeCart(w http.ResponseWriter, c cart, err error, status int) {
+	if err != nil {
+		http.Error(w, err.Error(), cartErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(c)
+}
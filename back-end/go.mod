@@ -3,6 +3,7 @@ module github.com/arman-madi/handson-opentelemetry/back-end
 go 1.16
 
 require (
+	github.com/arman-madi/handson-opentelemetry/common v0.0.0
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.26.0
 	go.opentelemetry.io/otel v1.1.0
@@ -14,5 +15,8 @@ require (
 	go.opentelemetry.io/otel/sdk v1.1.0
 	go.opentelemetry.io/otel/sdk/metric v0.24.0
 	go.opentelemetry.io/otel/trace v1.1.0
-	google.golang.org/grpc v1.41.0
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40 // indirect
+	golang.org/x/text v0.3.2 // indirect
 )
+
+replace github.com/arman-madi/handson-opentelemetry/common => ../common
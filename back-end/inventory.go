@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errOutOfStock is returned when the inventory cannot hold the basket, either
+// because an item is not in stock anymore or because it is not sold at all.
+var errOutOfStock = errors.New("basket not available")
+
+// inventory runs one phase (reserve, release or commit) of the reservation of
+// the basket of the order in its own span and returns the reservation id.
+func inventory(ctx context.Context, phase string, orderID string, order Order, reservationId string) (string, error) {
+	ctx, span := tracer.Start(ctx, "inventory-"+phase, trace.WithAttributes(attribute.String("order-id", orderID)))
+	defer span.End()
+
+	httpClient := &http.Client{
+		Transport: otelhttp.NewTransport(common.ServiceTLS.Transport),
+	}
+
+	payload, _ := json.Marshal(struct {
+		OrderID       string   `json:"order-id"`
+		Basket        []string `json:"basket,omitempty"`
+		ReservationID string   `json:"reservation-id,omitempty"`
+	}{orderID, order.Basket, reservationId})
+	req, _ := http.NewRequestWithContext(ctx, "POST", common.ServiceTLS.Scheme()+"://inventory/"+phase, bytes.NewBuffer(payload))
+	common.SetBudget(ctx, req)
+	if key := common.DerivedIdempotencyKey(ctx, "inventory-"+phase); key != "" {
+		req.Header.Set(common.IdempotencyHeader, key)
+	}
+
+	done, err := common.Breakers.Get("inventory").Allow(ctx)
+	if err != nil {
+		return "", err
+	}
+	res, err := httpClient.Do(req)
+	done(err != nil || res.StatusCode >= http.StatusInternalServerError)
+
+	if err != nil {
+		span.AddEvent("Error sending request", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict && phase == "reserve" {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		span.AddEvent("Basket not available", trace.WithAttributes(attribute.Key("reason").String(strings.TrimSpace(string(msg)))))
+		return "", fmt.Errorf("%w: %s", errOutOfStock, strings.TrimSpace(string(msg)))
+	}
+
+	if res.StatusCode != 200 {
+		span.AddEvent("Error Inventory", trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+		return "", fmt.Errorf("inventory %s failed with status %d", phase, res.StatusCode)
+	}
+
+	var r struct {
+		ID string `json:"reservation-id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		span.AddEvent("Error decoding inventory response", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return "", err
+	}
+
+	span.SetAttributes(attribute.String("reservation-id", r.ID))
+	span.AddEvent(fmt.Sprintf("Successfully inventory %s handled", phase))
+	return r.ID, nil
+}
+
+// inventoryErrorStatus is the status a checkout is answered with when the
+// basket could not be reserved.
+func inventoryErrorStatus(err error) int {
+	if errors.Is(err, errOutOfStock) {
+		return http.StatusConflict
+	}
+	return http.StatusBadGateway
+}
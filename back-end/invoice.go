@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errInvoiceNotFound = errors.New("invoice not found")
+
+// shopCurrency is the currency the items are priced and invoiced in, orders
+// may be charged in another one which payment-gateway converts the total to.
+const shopCurrency = "USD"
+
+// currencyPattern matches ISO 4217 currency codes.
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// taxRate is applied to the subtotal of every invoice, TAX_RATE or 10% by
+// default.
+var taxRate = func() float64 {
+	if r, err := strconv.ParseFloat(getenv("TAX_RATE", ""), 64); err == nil && r >= 0 {
+		return r
+	}
+	return 0.10
+}()
+
+type invoiceLine struct {
+	Item      string `json:"item"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit-price"`
+	Amount    int64  `json:"amount"`
+}
+
+// invoiceDoc is the invoice of an order. Amounts are in cents of Currency,
+// ChargeCurrency is set when the total is charged in another currency.
+type invoiceDoc struct {
+	Number         string        `json:"invoice-number"`
+	OrderID        string        `json:"order-id"`
+	IssuedAt       time.Time     `json:"issued-at"`
+	Customer       string        `json:"customer"`
+	Address        string        `json:"address"`
+	Payment        string        `json:"payment"`
+	Shipping       string        `json:"shipping"`
+	Currency       string        `json:"currency"`
+	ChargeCurrency string        `json:"charge-currency,omitempty"`
+	Lines          []invoiceLine `json:"lines"`
+	Subtotal       int64         `json:"subtotal"`
+	TaxRate        float64       `json:"tax-rate"`
+	Tax            int64         `json:"tax"`
+	Total          int64         `json:"total"`
+}
+
+// newInvoice prices the basket of order, the same items of the basket make
+// up one line.
+func newInvoice(orderID string, order Order, taxRate float64) invoiceDoc {
+	inv := invoiceDoc{
+		Number:   "INV-" + strings.TrimPrefix(orderID, "ORD-"),
+		OrderID:  orderID,
+		IssuedAt: time.Now().UTC(),
+		Customer: order.Name,
+		Address:  order.Address,
+		Payment:  order.Payment,
+		Shipping: order.Shipping,
+		Currency: shopCurrency,
+		TaxRate:  taxRate,
+	}
+	if order.Currency != shopCurrency {
+		inv.ChargeCurrency = order.Currency
+	}
+
+	lines := make(map[string]int)
+	for _, item := range order.Basket {
+		if _, ok := lines[item]; !ok {
+			lines[item] = len(inv.Lines)
+			inv.Lines = append(inv.Lines, invoiceLine{Item: item, UnitPrice: priceOf(item)})
+		}
+		l := &inv.Lines[lines[item]]
+		l.Quantity++
+		l.Amount += l.UnitPrice
+	}
+
+	for _, l := range inv.Lines {
+		inv.Subtotal += l.Amount
+	}
+	inv.Tax = int64(math.Round(float64(inv.Subtotal) * taxRate))
+	inv.Total = inv.Subtotal + inv.Tax
+	return inv
+}
+
+// priceOf is the unit price of an item in cents of shopCurrency. There is no catalog, so it is
+// derived from the name and stays the same for the same item.
+func priceOf(item string) int64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(item))
+	return 100 + int64(h.Sum32()%100000)
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"money": func(cents int64) string { return fmt.Sprintf("%d.%02d", cents/100, cents%100) },
+	"percent": func(rate float64) string {
+		return fmt.Sprintf("%g%%", rate*100)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Invoice {{.Number}}</title></head>
+<body>
+<h1>Invoice {{.Number}}</h1>
+<p>Order {{.OrderID}}, issued {{.IssuedAt.Format "2006-01-02 15:04 MST"}}</p>
+<p>{{.Customer}}<br>{{.Address}}</p>
+<p>Paid with {{.Payment}}, shipped with {{.Shipping}}</p>
+<table>
+<tr><th>Item</th><th>Quantity</th><th>Unit price</th><th>Amount</th></tr>
+{{- range .Lines}}
+<tr><td>{{.Item}}</td><td>{{.Quantity}}</td><td>{{money .UnitPrice}}</td><td>{{money .Amount}}</td></tr>
+{{- end}}
+<tr><td colspan="3">Subtotal</td><td>{{money .Subtotal}}</td></tr>
+<tr><td colspan="3">Tax {{percent .TaxRate}}</td><td>{{money .Tax}}</td></tr>
+<tr><td colspan="3"><b>Total {{.Currency}}</b></td><td><b>{{money .Total}}</b></td></tr>
+</table>
+{{- with .ChargeCurrency}}
+<p>Charged in {{.}} at the exchange rate of the payment</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// renderedInvoice holds the formats an invoice is available in.
+type renderedInvoice struct {
+	html []byte
+	json []byte
+}
+
+func renderInvoice(ctx context.Context, inv invoiceDoc) (renderedInvoice, error) {
+	_, span := tracer.Start(ctx, "render-invoice", trace.WithAttributes(
+		attribute.String("invoice-number", inv.Number),
+		attribute.Int("invoice.lines", len(inv.Lines)),
+	))
+	defer span.End()
+
+	var r renderedInvoice
+	var html bytes.Buffer
+	if err := invoiceTemplate.Execute(&html, inv); err != nil {
+		span.AddEvent("Error rendering invoice", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return r, err
+	}
+	r.html = html.Bytes()
+
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		span.AddEvent("Error rendering invoice", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return r, err
+	}
+	r.json = data
+
+	span.SetAttributes(attribute.Int("invoice.html_bytes", len(r.html)), attribute.Int("invoice.json_bytes", len(r.json)))
+	return r, nil
+}
+
+// invoiceStore keeps the rendered invoices as files of a directory, named
+// after the order.
+type invoiceStore struct {
+	dir string
+}
+
+var orderIDPattern = regexp.MustCompile(`^ORD-[0-9a-f]{16}$`)
+
+func newInvoiceStore(dir string) (*invoiceStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &invoiceStore{dir: dir}, nil
+}
+
+func (s *invoiceStore) path(orderID, format string) (string, error) {
+	// the id comes from the URL, it must not reach outside the directory
+	if !orderIDPattern.MatchString(orderID) {
+		return "", errInvoiceNotFound
+	}
+	return filepath.Join(s.dir, orderID+"."+format), nil
+}
+
+// save writes every format to a temporary file and renames it, so a crash
+// never leaves a truncated invoice behind.
+func (s *invoiceStore) save(ctx context.Context, orderID string, r renderedInvoice) error {
+	_, span := tracer.Start(ctx, "store-invoice", trace.WithAttributes(attribute.String("order-id", orderID)))
+	defer span.End()
+
+	for format, data := range map[string][]byte{"html": r.html, "json": r.json} {
+		path, err := s.path(orderID, format)
+		if err == nil {
+			err = ioutil.WriteFile(path+".tmp", data, 0o600)
+		}
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			span.AddEvent("Error storing invoice", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *invoiceStore) load(ctx context.Context, orderID, format string) ([]byte, error) {
+	_, span := tracer.Start(ctx, "load-invoice", trace.WithAttributes(
+		attribute.String("order-id", orderID),
+		attribute.String("invoice.format", format),
+	))
+	defer span.End()
+
+	path, err := s.path(orderID, format)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errInvoiceNotFound
+	}
+	return data, err
+}
+
+// remove deletes the invoice of an order which did not go through.
+func (s *invoiceStore) remove(orderID string) {
+	for _, format := range []string{"html", "json"} {
+		if path, err := s.path(orderID, format); err == nil {
+			_ = os.Remove(path)
+		}
+	}
+}
+
+// serveInvoice answers GET /orders/{id}/invoice with the HTML invoice, or the
+// JSON one if it is asked for with ?format=json or the Accept header.
+func serveInvoice(w http.ResponseWriter, req *http.Request, invoices *invoiceStore, orderID string) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "html"
+		if strings.Contains(req.Header.Get("Accept"), "application/json") {
+			format = "json"
+		}
+	}
+	if format != "html" && format != "json" {
+		http.Error(w, "format must be html or json", http.StatusBadRequest)
+		return
+	}
+
+	data, err := invoices.load(req.Context(), orderID, format)
+	if errors.Is(err, errInvoiceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	_, _ = w.Write(data)
+}
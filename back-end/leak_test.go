@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/otel"
+)
+
+func TestMain(m *testing.M) {
+	tracer = otel.Tracer("backend-tracer")
+
+	// the downstream services hang until the request is given up
+	common.ServiceTLS.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	os.Exit(m.Run())
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestCancelledCheckoutsDoNotLeakGoroutines cancels checkouts while the
+// downstream services hang, and abandons the results of half of them as a
+// handler which returned early would. The calls must end with the request and
+// every goroutine they started must be gone shortly after.
+func TestCancelledCheckoutsDoNotLeakGoroutines(t *testing.T) {
+	order := Order{Name: "Arman", Address: "24 Ferdowsi St", Shipping: "TOLL", Payment: "PayPal", Basket: []string{"iPhone 13 pro"}}
+	invoices, err := newInvoiceStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		paid := make(chan error, 1)
+		go func() {
+			_, err := payment(ctx, "authorize", order, 1200, "")
+			paid <- err
+		}()
+		shipped := shipping(ctx, order)
+		orderID, err := newOrderID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoiced := invoice(ctx, invoices, newInvoice(orderID, order, taxRate))
+		cancel()
+
+		select {
+		case err := <-paid:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("payment returned %v, want %v", err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("payment did not return after the checkout was cancelled")
+		}
+
+		if i%2 == 1 {
+			continue
+		}
+		select {
+		case s := <-shipped:
+			if !errors.Is(s.Err, context.Canceled) {
+				t.Fatalf("shipping returned %v, want %v", s.Err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("shipping did not return after the checkout was cancelled")
+		}
+		select {
+		case <-invoiced:
+			// rendering may well be done before the cancellation
+		case <-time.After(time.Second):
+			t.Fatal("invoice did not return after the checkout was cancelled")
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		leaked := checkoutGoroutines()
+		if len(leaked) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkoutGoroutines returns the stacks of the goroutines still running a
+// part of a checkout.
+func checkoutGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	var running []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		for _, fn := range []string{"back-end.payment", "back-end.shipping", "back-end.invoice"} {
+			if strings.Contains(g, fn) {
+				running = append(running, g)
+				break
+			}
+		}
+	}
+	return running
+}
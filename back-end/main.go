@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/arman-madi/handson-opentelemetry/common"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -24,6 +26,7 @@ import (
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/metric/global"
 	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/metric/aggregator/histogram"
 	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
 	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
 	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
@@ -31,85 +34,136 @@ import (
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
 )
 
 type Order struct {
 	Name     string   `json:"name"`
 	Address  string   `json:"address"`
+	Email    string   `json:"email"`
 	Payment  string   `json:"payment"`
 	Shipping string   `json:"shipping"`
 	Basket   []string `json:"basket"`
+	CartID   string   `json:"cart-id"`
+	Currency string   `json:"currency"`
+	Card     Card     `json:"card"`
 }
 
-var logger = log.New(os.Stderr, "[back-end] ", log.Ldate|log.Ltime|log.Llongfile)
+// paymentMethods are the payment providers of the payment-gateway, in lower
+// case.
+var paymentMethods = map[string]bool{"paypal": true, "credit": true}
+
+// shippingCarriers are the carriers of the shipping-gateway, in lower case.
+var shippingCarriers = map[string]bool{"toll": true, "fedex": true, "dhl": true}
+
+var logger = common.NewLogger("back-end")
 
 // Create one tracer per package
 // NOTE: You only need a tracer if you are creating your own spans
 var tracer trace.Tracer
 
-// Initializes an OTLP exporter, and configures the corresponding trace and
-// metric providers.
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
 func initProvider() func() {
 	ctx := context.Background()
 
 	otelAgentAddr := "otel-collector:4317"
+
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithProcess(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithAttributes(
+			// the service name used to display traces in backends
+			semconv.ServiceNameKey.String("backend"),
+		),
+	)
+	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
 	metricClient := otlpmetricgrpc.NewClient(
-		otlpmetricgrpc.WithInsecure(),
-		otlpmetricgrpc.WithEndpoint(otelAgentAddr))
-	metricExp, err := otlpmetric.New(ctx, metricClient)
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.ExemplarMetricClient{Client: common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient})})
 	handleErr(err, "Failed to create the collector metric exporter")
 	pusher := controller.New(
 		processor.NewFactory(
-			simple.NewWithExactDistribution(),
+			// the latencies in ms are kept in buckets, which carry the
+			// exemplars of the traces they were taken in
+			simple.NewWithHistogramDistribution(histogram.WithExplicitBoundaries([]float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000})),
 			metricExp,
 		),
 		controller.WithExporter(metricExp),
 		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
 	)
 	global.SetMeterProvider(pusher)
 	err = pusher.Start(ctx)
 	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
 
 	traceClient := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
 		otlptracegrpc.WithEndpoint(otelAgentAddr),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()))
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
 	
-	traceExp, err := otlptrace.New(ctx, traceClient)
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
 	handleErr(err, "Failed to create the collector trace exporter")
-	res, err := resource.New(ctx,
-		resource.WithFromEnv(),
-		resource.WithProcess(),
-		resource.WithTelemetrySDK(),
-		resource.WithHost(),
-		resource.WithAttributes(
-			// the service name used to display traces in backends
-			semconv.ServiceNameKey.String("backend"),
-		),
-	)
-	handleErr(err, "failed to create resource")
 	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
 	)
 
-	// set global propagator to tracecontext (the default is no-op).
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 	otel.SetTracerProvider(tracerProvider)
 
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
 	return func() {
 		cxt, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
-		if err := traceExp.Shutdown(cxt); err != nil {
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
 			otel.Handle(err)
 		}
 		// pushes any last exports to the receiver
 		if err := pusher.Stop(cxt); err != nil {
 			otel.Handle(err)
 		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
 	}
 }
 
@@ -119,6 +173,13 @@ func handleErr(err error, message string) {
 	}
 }
 
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
 func main() {
 	logger.Println("Hello, this is back-end service which is first service to handle the user requests in order to demonestrate how OpenTelemetry works!")
 
@@ -153,18 +214,29 @@ func main() {
 			metric.WithDescription("The number of requests processed"),
 		)
 
+	orders := newOrderStore()
+	carts := newCartStore()
+	// invoices are kept on disk, next to nothing else of the order
+	invoices, err := newInvoiceStore(getenv("INVOICES_DIR", "invoices"))
+	handleErr(err, "Failed to open the invoice store")
+
 	checkoutHandler := func(w http.ResponseWriter, req *http.Request) {
-		logger.Print("New checkout request received.")
+		common.Logf(req.Context(), common.LevelInfo, "New checkout request received.\n")
 
 		startTime := time.Now()
 
 		ctx := req.Context()
-		ctx = baggage.ContextWithBaggage(ctx, bag)
+		// add to the baggage, which already holds the authenticated end-user
+		reqBag := baggage.FromContext(ctx)
+		for _, m := range bag.Members() {
+			reqBag, _ = reqBag.SetMember(m)
+		}
+		ctx = baggage.ContextWithBaggage(ctx, reqBag)
 
 		// otelhttp already started a new span for handle function so you may need just get the span and add some events as needed
 		span := trace.SpanFromContext(ctx)
 		traceId := span.SpanContext().TraceID().String()
-		logger.Printf("Handle request with trace id: %+v\n", traceId)
+		common.Logf(ctx, common.LevelInfo, "Handle request with trace id: %+v\n", traceId)
 
 		// bag := baggage.FromContext(ctx)
 		// ctx, span := tracer.Start(ctx, "checkout-handler")
@@ -177,18 +249,181 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		logger.Printf("New Checkout received: %+v\n", order)
+		common.Logf(ctx, common.LevelInfo, "New Checkout received: %+v\n", order)
+		// the method names the provider the payment-gateway sends the card to
+		if !paymentMethods[strings.ToLower(order.Payment)] {
+			http.Error(w, "payment must be one of PayPal or Credit", http.StatusBadRequest)
+			return
+		}
+		if !shippingCarriers[strings.ToLower(order.Shipping)] {
+			http.Error(w, "shipping must be one of TOLL, FedEx or DHL", http.StatusBadRequest)
+			return
+		}
+		// the order is charged in its currency, or shopCurrency without one
+		if order.Currency != "" && !currencyPattern.MatchString(order.Currency) {
+			http.Error(w, "currency must be an ISO 4217 currency code", http.StatusBadRequest)
+			return
+		}
+		// an empty basket would be charged nothing, which no provider accepts
+		if order.CartID == "" && len(order.Basket) == 0 {
+			http.Error(w, "either a cart-id or a basket", http.StatusBadRequest)
+			return
+		}
+
+		// a retried checkout keeps its order id, the downstream services see
+		// the same requests again then
+		orderID := common.DerivedIdempotencyKey(ctx, "order")
+		if orderID != "" {
+			orderID = "ORD-" + orderID[:16]
+		} else if orderID, err = newOrderID(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		span.SetAttributes(attribute.String("order-id", orderID))
+		// whether the order went through, everything done for it so far is
+		// undone otherwise
+		completed := false
+
+		// the client the order and its cart belong to
+		owner, _ := clientOf(req)
+
+		// a cart is checked out with its id instead of a basket, it is locked
+		// meanwhile and opened again if the checkout fails
+		if order.CartID != "" {
+			if len(order.Basket) > 0 {
+				http.Error(w, "either a cart-id or a basket", http.StatusBadRequest)
+				return
+			}
+			linked, _ := cartSpan(req, carts, "checkout-cart", order.CartID)
+			c, err := carts.beginCheckout(order.CartID, owner)
+			linked.End()
+			if err != nil {
+				http.Error(w, err.Error(), cartErrorStatus(err))
+				return
+			}
+			order.Basket = c.basket()
+			defer func() {
+				if completed {
+					carts.endCheckout(order.CartID, orderID)
+				} else {
+					carts.endCheckout(order.CartID, "")
+				}
+			}()
+		}
+
+		// the basket is held in the inventory while the checkout runs
+		reservationId, err := inventory(ctx, "reserve", orderID, order, "")
+		if err != nil {
+			if !common.WriteDeadlineExceeded(w, ctx, err) && !common.WriteCircuitOpen(w, err) {
+				http.Error(w, err.Error(), inventoryErrorStatus(err))
+			}
+			return
+		}
+		// an order which does not go through gives its basket back unless it was
+		// shipped already, and its invoice is thrown away. The release has to go
+		// out even if the budget of the checkout is used up. A retry of it
+		// reserves and authorizes anew then, instead of being replayed what was
+		// released and voided.
+		shippedOut := false
+		defer func() {
+			if !completed {
+				if !shippedOut {
+					releaseCtx, cancel := context.WithTimeout(detached{ctx}, compensationTimeout)
+					_, _ = inventory(releaseCtx, "release", orderID, order, reservationId)
+					cancel()
+					common.RenewIdempotencyKeys(ctx)
+				}
+				invoices.remove(orderID)
+			}
+		}()
+
+		// the invoice total is what is charged
+		inv := newInvoice(orderID, order, taxRate)
 
-		payment(ctx, order)
+		// the payment is only authorized here and captured once shipping is confirmed
+		txId, err := payment(ctx, "authorize", order, inv.Total, "")
+		if err != nil {
+			if !common.WriteDeadlineExceeded(w, ctx, err) && !common.WriteCircuitOpen(w, err) {
+				http.Error(w, err.Error(), paymentErrorStatus(err))
+			}
+			return
+		}
 
 		// ** Parallel operations
 		ch1 := shipping(ctx, order)
-		ch2 := invoice(ctx, order.Basket, order.Payment)
-		<-ch1
+		ch2 := invoice(ctx, invoices, inv)
+		shipped := <-ch1
 		<-ch2
 		// ***********************
 
-		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\"}\n", traceId))
+		tracking := shipped.TrackingNumber
+		if shipped.Err != nil || tracking == "" {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				span.AddEvent("Checkout cancelled by the client")
+			}
+			// release the authorized amount, nothing is going to be delivered. The
+			// void has to go out even if the budget of the checkout is used up.
+			voidCtx, cancel := context.WithTimeout(detached{ctx}, compensationTimeout)
+			_, _ = payment(voidCtx, "void", order, inv.Total, txId)
+			cancel()
+			if !common.WriteDeadlineExceeded(w, ctx, shipped.Err) && !common.WriteCircuitOpen(w, shipped.Err) {
+				http.Error(w, "shipping failed", http.StatusBadGateway)
+			}
+			return
+		}
+
+		// the basket left the stock for good once it is shipped, whether or not
+		// the capture goes through; giving it back would sell it twice
+		shippedOut = true
+		commitCtx, cancel := context.WithTimeout(detached{ctx}, compensationTimeout)
+		if _, err := inventory(commitCtx, "commit", orderID, order, reservationId); err != nil {
+			common.Logf(ctx, common.LevelError, "Failed to commit the reservation %s of %s: %v\n", reservationId, orderID, err)
+		}
+		cancel()
+
+		if _, err := payment(ctx, "capture", order, inv.Total, txId); err != nil {
+			// the authorization is kept, so the payment can still be captured by
+			// hand for the shipment on its way
+			span.AddEvent("Capture failed after shipping", trace.WithAttributes(
+				attribute.String("transaction-id", txId),
+				attribute.String("tracking-number", tracking),
+				attribute.Key("err").String(err.Error()),
+			))
+			common.Logf(ctx, common.LevelError, "Failed to capture %s of %s shipped as %s: %v\n", txId, orderID, tracking, err)
+			if !common.WriteDeadlineExceeded(w, ctx, err) && !common.WriteCircuitOpen(w, err) {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		completed = true
+
+		rec, err := orders.create(orderRecord{
+			ID:             orderID,
+			TransactionID:  txId,
+			Carrier:        order.Shipping,
+			TrackingNumber: tracking,
+			checkout:       span.SpanContext(),
+			name:           order.Name,
+			email:          order.Email,
+			owner:          owner,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"order-id\": \"%v\", \"transaction-id\": \"%v\", \"tracking-number\": \"%v\"}\n", traceId, rec.ID, txId, tracking))
+
+		notify(ctx, notification{
+			Type:           "order-confirmed",
+			Email:          order.Email,
+			Name:           order.Name,
+			OrderID:        rec.ID,
+			Items:          order.Basket,
+			Carrier:        order.Shipping,
+			TrackingNumber: tracking,
+			InvoiceURL:     publicURL + "/orders/" + rec.ID + "/invoice",
+		})
 
 		latencyMs := float64(time.Since(startTime)) / 1e6
 
@@ -198,19 +433,105 @@ func main() {
 			requestLatency.Measurement(latencyMs),
 			requestCount.Measurement(1),
 		)
+		common.RecordExemplar(ctx, "backend/request_latency", latencyMs)
 
 	}
 
-	otelHandler := otelhttp.NewHandler(http.HandlerFunc(checkoutHandler), "handle-checkout")
+	auth, err := newAuthenticator()
+	handleErr(err, "Failed to set up authentication")
+
+	// overload is rejected early: shedding before anything else is done for the
+	// request, the rate limit per address before the credentials are checked
+	// and the one per client once the client is known
+	limiter, addrLimiter, err := newRateLimiters(meter)
+	handleErr(err, "Failed to set up rate limiting")
+	shedder, err := newLoadShedder(meter)
+	handleErr(err, "Failed to set up load shedding")
+
+	// retried checkouts with the same Idempotency-Key must not charge and ship twice
+	idempotencyKeys := common.NewIdempotencyStore()
+	// the whole checkout, including the calls to the other services, has to be
+	// done within CHECKOUT_TIMEOUT
+	checkoutTimeout, err := time.ParseDuration(getenv("CHECKOUT_TIMEOUT", "10s"))
+	handleErr(err, "Invalid CHECKOUT_TIMEOUT")
+	otelHandler := otelhttp.NewHandler(common.Budgeted(checkoutTimeout, shedding(shedder, "checkout", rateLimited(addrLimiter, "checkout", authenticated(auth, rateLimited(limiter, "checkout", common.Idempotent(idempotencyKeys, http.HandlerFunc(checkoutHandler))))))), "handle-checkout")
 	http.Handle("/checkout", otelHandler)
 
+	ordersHandler := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// the order and its invoice, with the name and address of the customer,
+		// are only served to the client which checked it out
+		owner, _ := clientOf(req)
+		id := strings.TrimPrefix(req.URL.Path, "/orders/")
+		invoice := strings.HasSuffix(id, "/invoice")
+		id = strings.TrimSuffix(id, "/invoice")
+
+		rec, err := orders.get(id, owner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if invoice {
+			serveInvoice(w, req, invoices, id)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rec)
+	}
+	http.Handle("/orders/", otelhttp.NewHandler(rateLimited(addrLimiter, "orders", authenticated(auth, http.HandlerFunc(ordersHandler))), "handle-orders"))
+
+	// carts are filled over several requests and checked out with their id,
+	// behind the same overload protection as the checkout
+	cartHandler := otelhttp.NewHandler(shedding(shedder, "carts", rateLimited(addrLimiter, "carts", authenticated(auth, rateLimited(limiter, "carts", cartsHandler(carts))))), "handle-cart")
+	http.Handle("/carts", cartHandler)
+	http.Handle("/carts/", cartHandler)
+
+	// carriers push shipment status changes, signed with a shared secret
+	webhookSecret := []byte(getenv("WEBHOOK_SECRET", "handson-webhook-secret"))
+	http.Handle("/webhooks/shipping", otelhttp.NewHandler(shippingWebhookHandler(orders, webhookSecret), "handle-shipping-webhook"))
+
+	common.Breakers.RegisterMetrics(meter)
+
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"), common.ServiceDependency("inventory"), common.ServiceDependency("payment-gateway"), common.ServiceDependency("shipping-gateway"))
 	logger.Printf("Listening on port 80\n")
-	http.ListenAndServe(":80", nil)
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
 }
 
-func payment(ctx context.Context, order Order) {
+// compensationTimeout bounds the calls which clean up after a checkout, i.e.
+// voiding an authorized payment and releasing or committing the reservation of
+// the basket, which are not bound by the budget of the checkout.
+const compensationTimeout = 5 * time.Second
+
+// detached keeps the values of a context, i.e. the span, the baggage and the
+// idempotency key, but not its deadline and cancellation.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// errInvalidPayment is returned when the payment-gateway rejects the payment of
+// an order as invalid, e.g. because it cannot charge its currency.
+var errInvalidPayment = errors.New("invalid payment")
+
+// payment runs one phase (authorize, capture or void) of the order payment
+// through the payment-gateway in its own span and returns the transaction id.
+// amount is in cents of shopCurrency, the payment-gateway converts it to the
+// currency of the order.
+func payment(ctx context.Context, phase string, order Order, amount int64, txId string) (string, error) {
+	ctx, span := tracer.Start(ctx, "payment-"+phase)
+	defer span.End()
+
 	httpClient := &http.Client{
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		Transport: otelhttp.NewTransport(common.ServiceTLS.Transport),
 	}
 
 	// we're ignoring errors here since we know these values are valid,
@@ -220,73 +541,185 @@ func payment(ctx context.Context, order Order) {
 	// bag, _ := baggage.New(foo, bar)
 	// ctx = baggage.ContextWithBaggage(ctx, bag)
 
-	payload := fmt.Sprintf("{\"name\":\"%s\", \"amount\":%d, \"method\":\"%s\"}", order.Name, 12 /*calcAmount(ctx, order.Basket)*/, order.Payment)
-	req, _ := http.NewRequestWithContext(ctx, "POST", "http://payment-gateway/", bytes.NewBuffer([]byte(payload)))
+	// marshalled rather than formatted, a quote in any of the order's fields
+	// must not be able to override the amount or add fields
+	payload, err := json.Marshal(struct {
+		Name           string `json:"name"`
+		Amount         int64  `json:"amount"`
+		Currency       string `json:"currency"`
+		ChargeCurrency string `json:"charge-currency"`
+		Method         string `json:"method"`
+		TransactionID  string `json:"transaction-id"`
+		Card           Card   `json:"card"`
+	}{order.Name, amount, shopCurrency, order.Currency, order.Payment, txId, order.Card})
+	if err != nil {
+		return "", err
+	}
+	req, _ := http.NewRequestWithContext(ctx, "POST", common.ServiceTLS.Scheme()+"://payment-gateway/"+phase, bytes.NewReader(payload))
+	common.SetBudget(ctx, req)
+	if key := common.DerivedIdempotencyKey(ctx, "payment-"+phase); key != "" {
+		req.Header.Set(common.IdempotencyHeader, key)
+	}
 
+	done, err := common.Breakers.Get("payment-gateway").Allow(ctx)
+	if err != nil {
+		return "", err
+	}
 	res, err := httpClient.Do(req)
-
-	span := trace.SpanFromContext(ctx)
+	done(err != nil || res.StatusCode >= http.StatusInternalServerError)
 
 	if err != nil {
 		span.AddEvent("Error sending request", trace.WithAttributes(attribute.Key("err").String(err.Error())))
-		return
+		return "", err
 	}
 
 	defer res.Body.Close()
 
-	if res.StatusCode == 200 {
-		span.AddEvent("Successfully payment handeled")
-	} else {
+	if res.StatusCode == http.StatusPaymentRequired {
+		// the gateway already turned the decline reason into a message for the user
+		var decline struct {
+			Code    string `json:"decline-code"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&decline)
+		span.AddEvent("Payment declined", trace.WithAttributes(attribute.Key("decline-code").String(decline.Code)))
+		return "", errors.New(decline.Message)
+	}
+
+	if res.StatusCode == http.StatusBadRequest && phase == "authorize" {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		span.AddEvent("Payment rejected", trace.WithAttributes(attribute.Key("reason").String(strings.TrimSpace(string(msg)))))
+		return "", fmt.Errorf("%w: %s", errInvalidPayment, strings.TrimSpace(string(msg)))
+	}
+
+	if res.StatusCode != 200 {
 		span.AddEvent("Error Payment Gateway", trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+		return "", fmt.Errorf("payment %s failed with status %d", phase, res.StatusCode)
 	}
+
+	var tx struct {
+		ID       string `json:"transaction-id"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tx); err != nil {
+		span.AddEvent("Error decoding payment response", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return "", err
+	}
+
+	// what was charged, in the currency of the order
+	span.SetAttributes(attribute.String("transaction-id", tx.ID), attribute.Int64("amount", tx.Amount), attribute.String("currency", tx.Currency))
+	span.AddEvent(fmt.Sprintf("Successfully payment %s handeled", phase))
+	return tx.ID, nil
 }
 
-func shipping(ctx context.Context, order Order) <-chan bool {
-	r := make(chan bool)
+// paymentErrorStatus maps the errors of authorizing a payment to HTTP status
+// codes, declines and anything else the payment-gateway failed with are 402.
+func paymentErrorStatus(err error) int {
+	if errors.Is(err, errInvalidPayment) {
+		return http.StatusBadRequest
+	}
+	return http.StatusPaymentRequired
+}
+
+// shipment is the outcome of shipping an order.
+type shipment struct {
+	TrackingNumber string
+	Err            error
+}
+
+// shipping sends the order to the shipping-gateway and delivers the shipment
+// on the returned channel. The channel is buffered, so the goroutine ends even
+// if nobody waits for the shipment anymore.
+func shipping(ctx context.Context, order Order) <-chan shipment {
+	r := make(chan shipment, 1)
 
 	go func() {
 		httpClient := &http.Client{
-			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Transport: otelhttp.NewTransport(common.ServiceTLS.Transport),
+		}
+		// marshalled like the payment, a quote in the address must not be able
+		// to change the carrier or the basket
+		payload, err := json.Marshal(struct {
+			Address string   `json:"address"`
+			Vendor  string   `json:"vendor"`
+			Basket  []string `json:"basket"`
+		}{order.Address, order.Shipping, order.Basket})
+		if err != nil {
+			r <- shipment{Err: err}
+			return
+		}
+		req, _ := http.NewRequestWithContext(ctx, "POST", common.ServiceTLS.Scheme()+"://shipping-gateway/", bytes.NewReader(payload))
+		common.SetBudget(ctx, req)
+		if key := common.DerivedIdempotencyKey(ctx, "shipping"); key != "" {
+			req.Header.Set(common.IdempotencyHeader, key)
 		}
-		payload := fmt.Sprintf("{\"address\":\"%s\", \"vendor\":\"%s\", \"basket\":[\"%s\"]}", order.Address, order.Shipping, strings.Join(order.Basket, "\",\""))
-		req, _ := http.NewRequestWithContext(ctx, "POST", "http://shipping-gateway/", bytes.NewBuffer([]byte(payload)))
 
+		done, err := common.Breakers.Get("shipping-gateway").Allow(ctx)
+		if err != nil {
+			r <- shipment{Err: err}
+			return
+		}
 		res, err := httpClient.Do(req)
+		done(err != nil || res.StatusCode >= http.StatusInternalServerError)
 
 		span := trace.SpanFromContext(ctx)
 
 		if err != nil {
 			span.AddEvent("Error sending request", trace.WithAttributes(attribute.Key("err").String(err.Error())))
-			r <- false
+			r <- shipment{Err: err}
 		} else {
 
 			defer res.Body.Close()
 
+			var s struct {
+				TrackingNumber string `json:"tracking-number"`
+			}
 			if res.StatusCode == 200 {
-				span.AddEvent("Successfully shipping handeled")
+				_ = json.NewDecoder(res.Body).Decode(&s)
+				span.AddEvent("Successfully shipping handeled", trace.WithAttributes(attribute.Key("tracking-number").String(s.TrackingNumber)))
+				r <- shipment{TrackingNumber: s.TrackingNumber}
 			} else {
 				span.AddEvent("Error Shipping Gateway", trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+				r <- shipment{Err: fmt.Errorf("shipping failed with status %d", res.StatusCode)}
 			}
-
-			r <- true
 		}
 	}()
 
 	return r
 }
 
-func invoice(ctx context.Context, basket []string, payment string) <-chan bool {
-	r := make(chan bool)
+// invoice renders the invoice and stores it under its order, and delivers
+// whether it did on the returned channel, which is buffered like the one of
+// shipping.
+func invoice(ctx context.Context, invoices *invoiceStore, inv invoiceDoc) <-chan bool {
+	r := make(chan bool, 1)
+	orderID := inv.OrderID
 
 	go func() {
-		_, span := tracer.Start(ctx, "generating-invoice")
+		ctx, span := tracer.Start(ctx, "generating-invoice", trace.WithAttributes(attribute.String("order-id", orderID)))
 		defer span.End()
 
 		span.AddEvent("Start generating invoice")
 
-		<-time.After(60 * time.Millisecond)
-		logger.Printf("Basket is %v\n", basket)
+		rendered, err := renderInvoice(ctx, inv)
+		if err != nil {
+			r <- false
+			return
+		}
+		// nothing is stored for a checkout which was given up meanwhile
+		if err := ctx.Err(); err != nil {
+			span.AddEvent("Invoice cancelled", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			r <- false
+			return
+		}
+		if err := invoices.save(ctx, orderID, rendered); err != nil {
+			common.Logf(ctx, common.LevelError, "Failed to store the invoice of %s: %v\n", orderID, err)
+			r <- false
+			return
+		}
 
+		span.SetAttributes(attribute.String("invoice-number", inv.Number), attribute.Int64("invoice.total", inv.Total))
 		span.AddEvent("Successfully invoice generated")
 		r <- true
 	}()
@@ -308,9 +741,12 @@ func calcAmount(ctx context.Context, basket []string) int {
 
 	span.AddEvent("Start calculating total price")
 
-	<-time.After(6 * time.Millisecond)
+	if err := common.Sleep(ctx, 6*time.Millisecond); err != nil {
+		span.AddEvent("Price calculation cancelled", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return 0
+	}
 	total := len(basket) * rand.Intn(500)
-	logger.Printf("Total price is %v\n", total)
+	common.Logf(ctx, common.LevelInfo, "Total price is %v\n", total)
 
 	span.SetAttributes(attribute.Int("total-price", total))
 	span.AddEvent("Successfully total price calculated")
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// notificationTimeout bounds the delivery of a notification, which goes on
+// after the request it belongs to was answered.
+const notificationTimeout = 30 * time.Second
+
+// publicURL is where the customers reach the back-end, the links in the
+// emails point there.
+var publicURL = getenv("PUBLIC_URL", "http://localhost:8080")
+
+// notification is an email to the customer about their order, see the
+// notification service for the fields each type uses.
+type notification struct {
+	Type           string   `json:"type"`
+	Email          string   `json:"email"`
+	Name           string   `json:"name"`
+	OrderID        string   `json:"order-id"`
+	Items          []string `json:"items,omitempty"`
+	Carrier        string   `json:"carrier,omitempty"`
+	TrackingNumber string   `json:"tracking-number,omitempty"`
+	Status         string   `json:"status,omitempty"`
+	InvoiceURL     string   `json:"invoice-url,omitempty"`
+}
+
+// notify has the notification service email the customer in the background,
+// so the request which caused it is neither held up nor failed by it. Orders
+// placed without an email address get no notifications.
+func notify(ctx context.Context, n notification) {
+	if n.Email == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(detached{ctx}, notificationTimeout)
+	go func() {
+		defer cancel()
+		if err := sendNotification(ctx, n); err != nil {
+			common.Logf(ctx, common.LevelError, "Failed to notify about %s of %s: %v\n", n.Type, n.OrderID, err)
+		}
+	}()
+}
+
+func sendNotification(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify-"+n.Type, trace.WithAttributes(attribute.String("order-id", n.OrderID)))
+	defer span.End()
+
+	httpClient := &http.Client{
+		Transport: otelhttp.NewTransport(common.ServiceTLS.Transport),
+	}
+
+	payload, _ := json.Marshal(n)
+	req, _ := http.NewRequestWithContext(ctx, "POST", common.ServiceTLS.Scheme()+"://notification/notify", bytes.NewBuffer(payload))
+	common.SetBudget(ctx, req)
+	// the carriers may report the same status more than once, the customer
+	// still gets only one email about it
+	sum := sha256.Sum256([]byte(n.OrderID + "/" + n.Type + "/" + n.Status))
+	req.Header.Set(common.IdempotencyHeader, hex.EncodeToString(sum[:16]))
+
+	done, err := common.Breakers.Get("notification").Allow(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(req)
+	done(err != nil || res.StatusCode >= http.StatusInternalServerError)
+
+	if err != nil {
+		span.AddEvent("Error sending request", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		span.AddEvent("Error Notification", trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+		return fmt.Errorf("notification failed with status %d", res.StatusCode)
+	}
+
+	span.AddEvent("Successfully notified")
+	return nil
+}
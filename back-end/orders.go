@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errOrderNotFound = errors.New("order not found")
+
+type orderEvent struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// orderRecord is what back-end remembers of a completed checkout. Its status
+// starts as confirmed and then follows the shipment reported by the carrier.
+type orderRecord struct {
+	ID             string       `json:"order-id"`
+	Status         string       `json:"status"`
+	TransactionID  string       `json:"transaction-id"`
+	Carrier        string       `json:"carrier"`
+	TrackingNumber string       `json:"tracking-number"`
+	History        []orderEvent `json:"history"`
+	CreatedAt      time.Time    `json:"created-at"`
+	UpdatedAt      time.Time    `json:"updated-at"`
+
+	// the checkout span, later updates of the order link back to it
+	checkout trace.SpanContext
+	// whom the customer notifications go to, not part of the order as served
+	name  string
+	email string
+	// the client which checked it out, the only one it is served to
+	owner string
+}
+
+type orderStore struct {
+	mu         sync.Mutex
+	orders     map[string]*orderRecord
+	byTracking map[string]*orderRecord
+}
+
+func newOrderStore() *orderStore {
+	return &orderStore{
+		orders:     make(map[string]*orderRecord),
+		byTracking: make(map[string]*orderRecord),
+	}
+}
+
+// newOrderID returns the id of a new order. It is taken at the start of the
+// checkout already, as the invoice is made out to it.
+func newOrderID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ORD-" + hex.EncodeToString(b), nil
+}
+
+// create stores the order under its ID, or under a new one if it has none.
+func (s *orderStore) create(order orderRecord) (orderRecord, error) {
+	if order.ID == "" {
+		id, err := newOrderID()
+		if err != nil {
+			return orderRecord{}, err
+		}
+		order.ID = id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	order.Status = "confirmed"
+	order.History = []orderEvent{{order.Status, now}}
+	order.CreatedAt = now
+	order.UpdatedAt = now
+
+	rec := &order
+	s.orders[rec.ID] = rec
+	if rec.TrackingNumber != "" {
+		s.byTracking[rec.TrackingNumber] = rec
+	}
+	return *rec, nil
+}
+
+// get returns the order id of owner.
+func (s *orderStore) get(id, owner string) (orderRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.orders[id]
+	if !ok || rec.owner != owner {
+		return orderRecord{}, errOrderNotFound
+	}
+	return *rec, nil
+}
+
+func (s *orderStore) getByTracking(tracking string) (orderRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.byTracking[tracking]
+	if !ok {
+		return orderRecord{}, errOrderNotFound
+	}
+	return *rec, nil
+}
+
+// updateShipment moves the order with the given tracking number to status.
+func (s *orderStore) updateShipment(tracking, status string, at time.Time) (orderRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.byTracking[tracking]
+	if !ok {
+		return orderRecord{}, errOrderNotFound
+	}
+
+	rec.Status = status
+	rec.History = append(rec.History, orderEvent{status, at})
+	rec.UpdatedAt = time.Now().UTC()
+	return *rec, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tokenBucket holds up to burst tokens and refills at rate tokens a second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client, so a single caller can not
+// take all the checkout capacity. RATE_LIMIT_RPS sets the sustained rate of
+// every client (0 disables the limit) and RATE_LIMIT_BURST how many requests
+// it may send at once.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+
+	throttled metric.Int64Counter
+}
+
+// newRateLimiters returns the limit per client and the one per remote address,
+// which is checked before the client is authenticated so the failed attempts
+// are limited as well. RATE_LIMIT_ADDR_RPS and RATE_LIMIT_ADDR_BURST set the
+// latter, generous enough for the clients behind a shared address.
+func newRateLimiters(meter metric.Meter) (*rateLimiter, *rateLimiter, error) {
+	throttled := metric.Must(meter).
+		NewInt64Counter(
+			"backend/throttled_requests",
+			metric.WithDescription("The number of requests rejected since the client exceeded its rate limit"),
+		)
+
+	client, err := newRateLimiter("RATE_LIMIT_RPS", "5", "RATE_LIMIT_BURST", "10", throttled)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := newRateLimiter("RATE_LIMIT_ADDR_RPS", "20", "RATE_LIMIT_ADDR_BURST", "40", throttled)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, addr, nil
+}
+
+func newRateLimiter(rateEnv, rateDefault, burstEnv, burstDefault string, throttled metric.Int64Counter) (*rateLimiter, error) {
+	rate, err := strconv.ParseFloat(getenv(rateEnv, rateDefault), 64)
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("invalid %s %q", rateEnv, getenv(rateEnv, ""))
+	}
+	burst, err := strconv.Atoi(getenv(burstEnv, burstDefault))
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("invalid %s %q", burstEnv, getenv(burstEnv, ""))
+	}
+
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		swept:     time.Now(),
+		throttled: throttled,
+	}, nil
+}
+
+// take removes a token from the bucket of client. If there is none it returns
+// false and how long until the next one is available.
+func (l *rateLimiter) take(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// the buckets which would be full by now are the same as new ones
+	if now.Sub(l.swept) > time.Minute {
+		for c, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, c)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimited rejects the requests of a client beyond its rate limit with 429,
+// counted under route. Clients are told apart by their authenticated identity,
+// or by their address when there is none, as in front of authenticated.
+func rateLimited(l *rateLimiter, route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l.rate == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		client, method := clientOf(req)
+		ok, wait := l.take(client)
+		if ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		retryAfter := common.RetryAfterSeconds(wait)
+		trace.SpanFromContext(ctx).AddEvent("Rate limited", trace.WithAttributes(
+			attribute.String("client", client),
+			attribute.Float64("rate-limit.rps", l.rate),
+			attribute.Int("retry-after", retryAfter),
+		))
+		l.throttled.Add(ctx, 1, attribute.String("app", "backend"), attribute.String("route", route), attribute.String("auth_method", method))
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	})
+}
+
+// clientOf returns the key the rate limit of req is kept under and how the
+// client was identified.
+func clientOf(req *http.Request) (string, string) {
+	if ident, ok := identityFromContext(req.Context()); ok {
+		return ident.Method + ":" + ident.ID, ident.Method
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "addr:" + host, "addr"
+}
+
+// loadShedder bounds the number of checkouts and cart requests handled at
+// once with MAX_CONCURRENT_CHECKOUTS, every checkout fans out to several
+// services and queueing more of them only makes all of them slower.
+type loadShedder struct {
+	slots chan struct{}
+
+	shed metric.Int64Counter
+}
+
+func newLoadShedder(meter metric.Meter) (*loadShedder, error) {
+	limit, err := strconv.Atoi(getenv("MAX_CONCURRENT_CHECKOUTS", "32"))
+	if err != nil || limit < 1 {
+		return nil, fmt.Errorf("invalid MAX_CONCURRENT_CHECKOUTS %q", getenv("MAX_CONCURRENT_CHECKOUTS", ""))
+	}
+
+	s := &loadShedder{
+		slots: make(chan struct{}, limit),
+		shed: metric.Must(meter).
+			NewInt64Counter(
+				"backend/shed_requests",
+				metric.WithDescription("The number of requests rejected since too many were in flight"),
+			),
+	}
+	metric.Must(meter).
+		NewInt64GaugeObserver(
+			"backend/inflight_requests",
+			func(_ context.Context, result metric.Int64ObserverResult) {
+				result.Observe(int64(len(s.slots)), attribute.String("app", "backend"))
+			},
+			metric.WithDescription("The number of checkout and cart requests in flight"),
+		)
+	return s, nil
+}
+
+// shedding rejects the requests arriving while the limit of concurrent
+// requests is reached with 503, instead of queueing them, counted under route.
+func shedding(s *loadShedder, route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+			next.ServeHTTP(w, req)
+			return
+		default:
+		}
+
+		ctx := req.Context()
+		trace.SpanFromContext(ctx).AddEvent("Load shed", trace.WithAttributes(
+			attribute.Int("inflight", len(s.slots)),
+			attribute.Int("max-concurrent", cap(s.slots)),
+		))
+		s.shed.Add(ctx, 1, attribute.String("app", "backend"), attribute.String("route", route))
+
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "overloaded, try again later", http.StatusServiceUnavailable)
+	})
+}
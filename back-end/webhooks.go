@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// webhookTolerance is how old a signed callback may be before it is refused
+// as a possible replay.
+const webhookTolerance = 5 * time.Minute
+
+type shipmentUpdate struct {
+	Carrier        string    `json:"carrier"`
+	TrackingNumber string    `json:"tracking-number"`
+	Status         string    `json:"status"`
+	Time           time.Time `json:"time"`
+}
+
+// verifyWebhook checks the HMAC signature of a carrier callback, which is
+// computed over "<timestamp>.<body>" with the shared secret.
+func verifyWebhook(secret []byte, timestamp, signature string, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid webhook timestamp")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return errors.New("webhook timestamp out of tolerance")
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return errors.New("invalid webhook signature")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("webhook signature mismatch")
+	}
+	return nil
+}
+
+// shippingWebhookHandler receives the shipment status changes pushed by the
+// carriers and updates the matching order. The carrier starts a new trace for
+// each callback; the order update links back to the checkout trace.
+func shippingWebhookHandler(orders *orderStore, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = verifyWebhook(secret, req.Header.Get("X-Webhook-Timestamp"), req.Header.Get("X-Webhook-Signature"), body, time.Now())
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			span.AddEvent("Rejected webhook", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var update shipmentUpdate
+		if err := json.Unmarshal(body, &update); err != nil {
+			span.AddEvent("Error decoding webhook json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		common.Logf(ctx, common.LevelInfo, "Shipment %s of %s is %s\n", update.TrackingNumber, update.Carrier, update.Status)
+
+		order, err := orders.getByTracking(update.TrackingNumber)
+		if err != nil {
+			span.AddEvent("Unknown shipment", trace.WithAttributes(attribute.String("tracking-number", update.TrackingNumber)))
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		_, child := tracer.Start(ctx, "update-order-status",
+			trace.WithLinks(trace.Link{SpanContext: order.checkout}),
+			trace.WithAttributes(
+				attribute.String("order-id", order.ID),
+				attribute.String("tracking-number", update.TrackingNumber),
+				attribute.String("order-status", update.Status),
+			),
+		)
+		_, err = orders.updateShipment(update.TrackingNumber, update.Status, update.Time)
+		child.End()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// the customer already got the tracking number with the confirmation
+		if update.Status != "label-created" {
+			notify(ctx, notification{
+				Type:           "shipment-update",
+				Email:          order.email,
+				Name:           order.name,
+				OrderID:        order.ID,
+				TrackingNumber: update.TrackingNumber,
+				Status:         update.Status,
+			})
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
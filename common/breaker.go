@@ -0,0 +1,238 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type breakerState int
+
+// the values are reported by the circuit_breaker/state gauge
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// circuitOpenError fails a call to a downstream fast while its breaker is
+// open, without sending anything.
+type circuitOpenError struct {
+	downstream string
+	// retryAfter is how long the breaker stays open
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s unavailable: %v", e.downstream, ErrCircuitOpen)
+}
+
+func (e *circuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// WriteCircuitOpen answers 503 with a Retry-After header when err is a
+// circuitOpenError and reports whether it did.
+func WriteCircuitOpen(w http.ResponseWriter, err error) bool {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds(open.retryAfter)))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// RetryAfterSeconds rounds d up to the whole seconds of a Retry-After header.
+func RetryAfterSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// CircuitBreaker stops the calls to a downstream after failureThreshold
+// failures in a row. Once it was open for openTimeout it is half-open and lets
+// up to halfOpenRequests trial calls through: a success closes it again, a
+// failure opens it for another openTimeout.
+type CircuitBreaker struct {
+	downstream       string
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenRequests int
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+// Allow returns a circuitOpenError if the call must not be made. Otherwise
+// the caller must report whether the call failed with the returned func.
+func (b *CircuitBreaker) Allow(ctx context.Context) (func(failed bool), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if wait := b.openTimeout - time.Since(b.openedAt); wait > 0 {
+			return nil, b.reject(ctx, wait)
+		}
+		b.transition(ctx, breakerHalfOpen)
+	}
+
+	trial := b.state == breakerHalfOpen
+	if trial {
+		if b.trials >= b.halfOpenRequests {
+			return nil, b.reject(ctx, time.Second)
+		}
+		b.trials++
+	}
+	return func(failed bool) { b.done(ctx, trial, failed) }, nil
+}
+
+// reject fails a call fast, b.mu must be held.
+func (b *CircuitBreaker) reject(ctx context.Context, retryAfter time.Duration) error {
+	trace.SpanFromContext(ctx).AddEvent("Circuit breaker rejected call", trace.WithAttributes(
+		attribute.String("downstream", b.downstream),
+		attribute.String("state", b.state.String()),
+	))
+	return &circuitOpenError{downstream: b.downstream, retryAfter: retryAfter}
+}
+
+// done records the outcome of a call let through by allow. Calls abandoned by
+// the caller say nothing about the downstream and are not counted.
+func (b *CircuitBreaker) done(ctx context.Context, trial, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial && b.state == breakerHalfOpen {
+		b.trials--
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		if trial && b.state == breakerHalfOpen {
+			b.transition(ctx, breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if (trial && b.state == breakerHalfOpen) || (b.state == breakerClosed && b.failures >= b.failureThreshold) {
+		b.transition(ctx, breakerOpen)
+	}
+}
+
+// transition moves the breaker to state, b.mu must be held.
+func (b *CircuitBreaker) transition(ctx context.Context, state breakerState) {
+	from := b.state
+	b.state = state
+	b.trials = 0
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("Circuit breaker "+state.String(), trace.WithAttributes(
+		attribute.String("downstream", b.downstream),
+		attribute.String("from", from.String()),
+		attribute.String("to", state.String()),
+		attribute.Int("failures", b.failures),
+	))
+	Logf(ctx, LevelWarn, "Circuit breaker of %s changed from %s to %s\n", b.downstream, from, state)
+}
+
+// BreakerSet holds a circuit breaker per downstream, all configured by
+// BREAKER_FAILURE_THRESHOLD (5 by default), BREAKER_OPEN_TIMEOUT (10s) and
+// BREAKER_HALF_OPEN_REQUESTS (1).
+type BreakerSet struct {
+	mu       sync.Mutex
+	Breakers map[string]*CircuitBreaker
+
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenRequests int
+}
+
+var Breakers = newBreakerSet()
+
+func newBreakerSet() *BreakerSet {
+	s := &BreakerSet{
+		Breakers:         make(map[string]*CircuitBreaker),
+		failureThreshold: 5,
+		openTimeout:      10 * time.Second,
+		halfOpenRequests: 1,
+	}
+	if n, err := strconv.Atoi(getenv("BREAKER_FAILURE_THRESHOLD", "")); err == nil && n > 0 {
+		s.failureThreshold = n
+	}
+	if d, err := time.ParseDuration(getenv("BREAKER_OPEN_TIMEOUT", "")); err == nil && d > 0 {
+		s.openTimeout = d
+	}
+	if n, err := strconv.Atoi(getenv("BREAKER_HALF_OPEN_REQUESTS", "")); err == nil && n > 0 {
+		s.halfOpenRequests = n
+	}
+	return s
+}
+
+// Get returns the breaker of downstream, creating a closed one on first use.
+func (s *BreakerSet) Get(downstream string) *CircuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.Breakers[downstream]
+	if !ok {
+		b = &CircuitBreaker{
+			downstream:       downstream,
+			failureThreshold: s.failureThreshold,
+			openTimeout:      s.openTimeout,
+			halfOpenRequests: s.halfOpenRequests,
+		}
+		s.Breakers[downstream] = b
+	}
+	return b
+}
+
+// RegisterMetrics observes the state of the Breakers with meter.
+func (s *BreakerSet) RegisterMetrics(meter metric.Meter) {
+	metric.Must(meter).
+		NewInt64GaugeObserver(
+			"circuit_breaker/state",
+			func(_ context.Context, result metric.Int64ObserverResult) {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				for _, b := range s.Breakers {
+					b.mu.Lock()
+					state := b.state
+					b.mu.Unlock()
+					result.Observe(int64(state), attribute.String("downstream", b.downstream))
+				}
+			},
+			metric.WithDescription("The state of the circuit breaker of the downstream, 0 closed, 1 half-open and 2 open"),
+		)
+}
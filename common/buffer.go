@@ -0,0 +1,163 @@
+package common
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The disk buffer is optional: it is enabled by pointing TELEMETRY_BUFFER_DIR
+// at a directory, and each signal keeps at most TELEMETRY_BUFFER_MAX_MB
+// (64 by default) there.
+
+func telemetryBuffer() (dir string, maxSize int64) {
+	maxMB, err := strconv.ParseInt(getenv("TELEMETRY_BUFFER_MAX_MB", "64"), 10, 64)
+	if err != nil || maxMB <= 0 {
+		maxMB = 64
+	}
+	return getenv("TELEMETRY_BUFFER_DIR", ""), maxMB << 20
+}
+
+// BufferTraces puts the disk buffer in front of client, if it is enabled.
+func BufferTraces(client otlptrace.Client) otlptrace.Client {
+	dir, maxSize := telemetryBuffer()
+	if dir == "" {
+		return client
+	}
+	return &bufferedTraceClient{Client: client, dir: filepath.Join(dir, "traces"), maxSize: maxSize}
+}
+
+// BufferMetrics puts the disk buffer in front of client, if it is enabled.
+func BufferMetrics(client otlpmetric.Client) otlpmetric.Client {
+	dir, maxSize := telemetryBuffer()
+	if dir == "" {
+		return client
+	}
+	return &bufferedMetricClient{Client: client, dir: filepath.Join(dir, "metrics"), maxSize: maxSize}
+}
+
+// bufferedTraceClient writes every batch of spans to the disk queue, which
+// uploads it with the wrapped client.
+type bufferedTraceClient struct {
+	otlptrace.Client
+	dir     string
+	maxSize int64
+	queue   *diskQueue
+}
+
+func (c *bufferedTraceClient) Start(ctx context.Context) error {
+	if err := c.Client.Start(ctx); err != nil {
+		return err
+	}
+
+	queue, err := newDiskQueue("traces", c.dir, c.maxSize, func(ctx context.Context, data []byte) error {
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			// a corrupt batch would never get through, so it is given up
+			Logf(ctx, LevelWarn, "Discarding unreadable buffered spans: %v\n", err)
+			return nil
+		}
+		return c.Client.UploadTraces(ctx, req.ResourceSpans)
+	})
+	if err != nil {
+		return err
+	}
+	c.queue = queue
+	TelemetryHealth.addBuffer(queue)
+	return nil
+}
+
+func (c *bufferedTraceClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	var spans int64
+	for _, rs := range protoSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			spans += int64(len(ils.Spans))
+		}
+	}
+
+	data, err := proto.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: protoSpans})
+	if err == nil {
+		err = c.queue.push(data, spans)
+	}
+	if err != nil {
+		// the disk is not usable, better to try the collector directly than
+		// to lose the spans
+		Logf(ctx, LevelError, "Failed to buffer %d spans on disk: %v\n", spans, err)
+		return c.Client.UploadTraces(ctx, protoSpans)
+	}
+	return nil
+}
+
+func (c *bufferedTraceClient) Stop(ctx context.Context) error {
+	if err := c.queue.close(ctx); err != nil {
+		Logf(ctx, LevelWarn, "Failed to send the buffered spans: %v\n", err)
+	}
+	return c.Client.Stop(ctx)
+}
+
+// bufferedMetricClient writes every batch of metrics to the disk queue, which
+// uploads it with the wrapped client.
+type bufferedMetricClient struct {
+	otlpmetric.Client
+	dir     string
+	maxSize int64
+	queue   *diskQueue
+}
+
+func (c *bufferedMetricClient) Start(ctx context.Context) error {
+	if err := c.Client.Start(ctx); err != nil {
+		return err
+	}
+
+	queue, err := newDiskQueue("metrics", c.dir, c.maxSize, func(ctx context.Context, data []byte) error {
+		var req colmetricpb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			// a corrupt batch would never get through, so it is given up
+			Logf(ctx, LevelWarn, "Discarding unreadable buffered metrics: %v\n", err)
+			return nil
+		}
+		return c.Client.UploadMetrics(ctx, req.ResourceMetrics)
+	})
+	if err != nil {
+		return err
+	}
+	c.queue = queue
+	TelemetryHealth.addBuffer(queue)
+	return nil
+}
+
+func (c *bufferedMetricClient) UploadMetrics(ctx context.Context, protoMetrics []*metricpb.ResourceMetrics) error {
+	var metrics int64
+	for _, rm := range protoMetrics {
+		for _, ilm := range rm.InstrumentationLibraryMetrics {
+			metrics += int64(len(ilm.Metrics))
+		}
+	}
+
+	data, err := proto.Marshal(&colmetricpb.ExportMetricsServiceRequest{ResourceMetrics: protoMetrics})
+	if err == nil {
+		err = c.queue.push(data, metrics)
+	}
+	if err != nil {
+		// the disk is not usable, better to try the collector directly than
+		// to lose the metrics
+		Logf(ctx, LevelError, "Failed to buffer %d metrics on disk: %v\n", metrics, err)
+		return c.Client.UploadMetrics(ctx, protoMetrics)
+	}
+	return nil
+}
+
+func (c *bufferedMetricClient) Stop(ctx context.Context) error {
+	if err := c.queue.close(ctx); err != nil {
+		Logf(ctx, LevelWarn, "Failed to send the buffered metrics: %v\n", err)
+	}
+	return c.Client.Stop(ctx)
+}
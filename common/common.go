@@ -0,0 +1,33 @@
+// Package common is the code every service of the shop shares: the export of
+// the telemetry with its disk buffer and exemplars, the redaction of personal data, the
+// health probes, TLS, graceful shutdown, deadline budgets, idempotency keys,
+// the circuit breakers and retries of the calls to other services, the
+// transactions of the payment providers, and the shipments of the carriers
+// and their webhooks.
+//
+// The services pull it in with a replace directive of their go.mod, so a fix
+// lands in all of them at once.
+package common
+
+import (
+	"log"
+	"os"
+)
+
+// Logger is what the shared code logs to. NewLogger names it after the
+// service, which then logs to it as well.
+var Logger = log.New(NewRedactingWriter(os.Stderr), "", log.Ldate|log.Ltime|log.Llongfile)
+
+// NewLogger prefixes the lines of Logger with the name of the service and
+// returns it.
+func NewLogger(service string) *log.Logger {
+	Logger.SetPrefix("[" + service + "] ")
+	return Logger
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BudgetHeader carries the time left for a request in milliseconds from
+// service to service, so none of them keeps working on it once the caller
+// gave up anyway.
+const BudgetHeader = "X-Request-Budget-Ms"
+
+// Budgeted bounds the context of the requests by the budget they were sent
+// with, but never by more than limit. Requests without a budget get limit,
+// or no deadline at all if limit is 0. Requests whose budget is already used
+// up are answered with 504 right away.
+func Budgeted(limit time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+
+		budget := limit
+		if v := req.Header.Get(BudgetHeader); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid "+BudgetHeader, http.StatusBadRequest)
+				return
+			}
+			budget = time.Duration(ms) * time.Millisecond
+			if limit > 0 && budget > limit {
+				budget = limit
+			}
+			if budget <= 0 {
+				span.AddEvent("Deadline budget exhausted", trace.WithAttributes(attribute.Int64("deadline.budget_ms", ms)))
+				http.Error(w, "deadline budget exhausted", http.StatusGatewayTimeout)
+				return
+			}
+		}
+		if budget <= 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		span.SetAttributes(attribute.Int64("deadline.budget_ms", budget.Milliseconds()))
+		ctx, cancel := context.WithTimeout(ctx, budget)
+		defer cancel()
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// SetBudget passes what is left of the deadline of ctx on with req.
+func SetBudget(ctx context.Context, req *http.Request) {
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(BudgetHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+}
+
+// WriteDeadlineExceeded answers 504 if err, or the request as a whole, ran
+// out of its budget and reports whether it did.
+func WriteDeadlineExceeded(w http.ResponseWriter, ctx context.Context, err error) bool {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	trace.SpanFromContext(ctx).AddEvent("Deadline budget exhausted")
+	http.Error(w, "deadline budget exhausted", http.StatusGatewayTimeout)
+	return true
+}
+
+// Sleep waits for d, or returns the error of ctx once it is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BudgetProcessor records on every span how much of the deadline of its
+// request was left when it started.
+type BudgetProcessor struct{}
+
+func (BudgetProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	if deadline, ok := parent.Deadline(); ok {
+		s.SetAttributes(attribute.Int64("deadline.remaining_ms", time.Until(deadline).Milliseconds()))
+	}
+}
+
+func (BudgetProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (BudgetProcessor) Shutdown(context.Context) error   { return nil }
+func (BudgetProcessor) ForceFlush(context.Context) error { return nil }
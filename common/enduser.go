@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"net/url"
+
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// Baggage members back-end forwards the authenticated end-user in.
+const (
+	BaggageEnduserID   = "enduser.id"
+	BaggageEnduserRole = "enduser.role"
+)
+
+// EnduserProcessor copies the end-user identity from the baggage onto every
+// span, so the spans of all services can be searched by end-user.
+type EnduserProcessor struct{}
+
+func (EnduserProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	bag := baggage.FromContext(parent)
+	if id := unescapeMember(bag, BaggageEnduserID); id != "" {
+		s.SetAttributes(semconv.EnduserIDKey.String(id))
+	}
+	if role := unescapeMember(bag, BaggageEnduserRole); role != "" {
+		s.SetAttributes(semconv.EnduserRoleKey.String(role))
+	}
+}
+
+// unescapeMember returns the value of the baggage member key, which back-end
+// query escapes.
+func unescapeMember(bag baggage.Baggage, key string) string {
+	v, err := url.QueryUnescape(bag.Member(key).Value())
+	if err != nil {
+		return ""
+	}
+	return v
+}
+
+func (EnduserProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (EnduserProcessor) Shutdown(context.Context) error   { return nil }
+func (EnduserProcessor) ForceFlush(context.Context) error { return nil }
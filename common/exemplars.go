@@ -0,0 +1,110 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/trace"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// The metric SDK keeps no exemplars yet, so the values recorded in sampled
+// spans are kept here until the next export and attached to the histogram
+// points of their instrument by ExemplarMetricClient. The collector exposes
+// them to Prometheus in the OpenMetrics format, so a slow bucket can jump
+// straight to the matching trace.
+
+// maxPendingExemplars bounds the exemplars an instrument keeps between two
+// exports, the oldest are dropped first.
+const maxPendingExemplars = 64
+
+var exemplars = struct {
+	mu      sync.Mutex
+	pending map[string][]*metricpb.Exemplar
+}{pending: make(map[string][]*metricpb.Exemplar)}
+
+// RecordExemplar keeps value, which was just recorded with the histogram
+// instrument, as an exemplar of the span in ctx if it is sampled.
+func RecordExemplar(ctx context.Context, instrument string, value float64) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return
+	}
+	traceID, spanID := sc.TraceID(), sc.SpanID()
+	e := &metricpb.Exemplar{
+		TimeUnixNano: uint64(time.Now().UnixNano()),
+		Value:        &metricpb.Exemplar_AsDouble{AsDouble: value},
+		TraceId:      traceID[:],
+		SpanId:       spanID[:],
+	}
+
+	exemplars.mu.Lock()
+	defer exemplars.mu.Unlock()
+	pending := append(exemplars.pending[instrument], e)
+	if len(pending) > maxPendingExemplars {
+		pending = pending[len(pending)-maxPendingExemplars:]
+	}
+	exemplars.pending[instrument] = pending
+}
+
+// takeExemplars returns the exemplars kept for instrument since the last
+// export and forgets them.
+func takeExemplars(instrument string) []*metricpb.Exemplar {
+	exemplars.mu.Lock()
+	defer exemplars.mu.Unlock()
+	pending := exemplars.pending[instrument]
+	delete(exemplars.pending, instrument)
+	return pending
+}
+
+// ExemplarMetricClient attaches the kept exemplars to the histogram points
+// before they are uploaded, the latest one of each bucket. It goes in front
+// of the disk buffer so the exemplars are sent along with the points they
+// were taken for.
+type ExemplarMetricClient struct {
+	otlpmetric.Client
+}
+
+func (c ExemplarMetricClient) UploadMetrics(ctx context.Context, protoMetrics []*metricpb.ResourceMetrics) error {
+	for _, rm := range protoMetrics {
+		for _, ilm := range rm.InstrumentationLibraryMetrics {
+			for _, m := range ilm.Metrics {
+				if h := m.GetHistogram(); h != nil {
+					attachExemplars(h.DataPoints, takeExemplars(m.Name))
+				}
+			}
+		}
+	}
+	return c.Client.UploadMetrics(ctx, protoMetrics)
+}
+
+func attachExemplars(points []*metricpb.HistogramDataPoint, pending []*metricpb.Exemplar) {
+	if len(pending) == 0 {
+		return
+	}
+	for _, p := range points {
+		latest := make(map[int]*metricpb.Exemplar)
+		for _, e := range pending {
+			latest[bucketOf(p.ExplicitBounds, e.GetAsDouble())] = e
+		}
+		p.Exemplars = make([]*metricpb.Exemplar, 0, len(latest))
+		for i := 0; i <= len(p.ExplicitBounds); i++ {
+			if e, ok := latest[i]; ok {
+				p.Exemplars = append(p.Exemplars, e)
+			}
+		}
+	}
+}
+
+// bucketOf returns the index of the bucket of value, a value on a bound
+// counts to the bucket above it as in the histogram aggregator of the SDK.
+func bucketOf(bounds []float64, value float64) int {
+	for i, b := range bounds {
+		if value < b {
+			return i
+		}
+	}
+	return len(bounds)
+}
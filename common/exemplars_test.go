@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+type recordingMetricClient struct {
+	uploaded []*metricpb.ResourceMetrics
+}
+
+func (c *recordingMetricClient) Start(context.Context) error { return nil }
+func (c *recordingMetricClient) Stop(context.Context) error  { return nil }
+func (c *recordingMetricClient) UploadMetrics(_ context.Context, protoMetrics []*metricpb.ResourceMetrics) error {
+	c.uploaded = protoMetrics
+	return nil
+}
+
+func latencyMetrics() []*metricpb.ResourceMetrics {
+	return []*metricpb.ResourceMetrics{{
+		InstrumentationLibraryMetrics: []*metricpb.InstrumentationLibraryMetrics{{
+			Metrics: []*metricpb.Metric{{
+				Name: "backend/request_latency",
+				Data: &metricpb.Metric_Histogram{Histogram: &metricpb.Histogram{
+					DataPoints: []*metricpb.HistogramDataPoint{{ExplicitBounds: []float64{10, 100}}},
+				}},
+			}},
+		}},
+	}}
+}
+
+// TestExemplarsLandInTheirBuckets records latencies in sampled and unsampled
+// spans and uploads a histogram with the buckets below 10, below 100 and
+// above. Every bucket must carry the latest sampled latency which fell into
+// it, and an exemplar is only ever sent once.
+func TestExemplarsLandInTheirBuckets(t *testing.T) {
+	sampled := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	unsampled := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{2},
+		SpanID:  trace.SpanID{2},
+	}))
+
+	RecordExemplar(sampled, "backend/request_latency", 5)
+	RecordExemplar(sampled, "backend/request_latency", 7)
+	RecordExemplar(sampled, "backend/request_latency", 100)
+	RecordExemplar(unsampled, "backend/request_latency", 500)
+
+	recorder := &recordingMetricClient{}
+	client := ExemplarMetricClient{Client: recorder}
+	if err := client.UploadMetrics(context.Background(), latencyMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	point := recorder.uploaded[0].InstrumentationLibraryMetrics[0].Metrics[0].GetHistogram().DataPoints[0]
+	if len(point.Exemplars) != 2 || point.Exemplars[0].GetAsDouble() != 7 || point.Exemplars[1].GetAsDouble() != 100 {
+		t.Fatalf("exemplars are %v, want 7 and 100", point.Exemplars)
+	}
+	if want := (trace.TraceID{1}); string(point.Exemplars[0].TraceId) != string(want[:]) {
+		t.Errorf("exemplar of trace %x, want %v", point.Exemplars[0].TraceId, want)
+	}
+
+	if err := client.UploadMetrics(context.Background(), latencyMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	point = recorder.uploaded[0].InstrumentationLibraryMetrics[0].Metrics[0].GetHistogram().DataPoints[0]
+	if len(point.Exemplars) != 0 {
+		t.Errorf("the next upload carried %v again, want no exemplars", point.Exemplars)
+	}
+}
@@ -0,0 +1,16 @@
+module github.com/arman-madi/handson-opentelemetry/common
+
+go 1.16
+
+require (
+	go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace v0.25.0
+	go.opentelemetry.io/otel v1.1.0
+	go.opentelemetry.io/otel/exporters/otlp/otlpmetric v0.24.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.1.0
+	go.opentelemetry.io/otel/metric v0.24.0
+	go.opentelemetry.io/otel/sdk v1.1.0
+	go.opentelemetry.io/otel/trace v1.1.0
+	go.opentelemetry.io/proto/otlp v0.9.0
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
+)
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds every dependency check, so a hanging dependency
+// makes the service unready instead of hanging the probe.
+const healthCheckTimeout = 2 * time.Second
+
+// Dependency is something the service needs to do its job. Check returns
+// nil when the dependency is usable.
+type Dependency struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type dependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency-ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CollectorDependency checks that the OTLP receiver of the collector accepts
+// connections, which is what all the exporters of the service talk to.
+func CollectorDependency(addr string) Dependency {
+	return Dependency{
+		Name: "otel-collector",
+		Check: func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	}
+}
+
+// ServiceDependency checks the liveness of a downstream service. Only its
+// /healthz is asked, not its /readyz, so one dependency being down does not
+// turn the whole chain unready.
+func ServiceDependency(name string) Dependency {
+	return Dependency{
+		Name: name,
+		Check: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s://%s/healthz", ServiceTLS.Scheme(), name), nil)
+			if err != nil {
+				return err
+			}
+			res, err := (&http.Client{Transport: ServiceTLS.Transport}).Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s answered with status %d", name, res.StatusCode)
+			}
+			return nil
+		},
+	}
+}
+
+// HandleHealth registers the liveness (/healthz) and readiness (/readyz)
+// probes. They are left out of the traces on purpose, otherwise the probes
+// would drown the interesting requests.
+func HandleHealth(mux *http.ServeMux, deps ...Dependency) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+		defer cancel()
+
+		statuses := make(map[string]dependencyStatus, len(deps))
+		ready := true
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, dep := range deps {
+			wg.Add(1)
+			go func(dep Dependency) {
+				defer wg.Done()
+
+				start := time.Now()
+				err := dep.Check(ctx)
+				st := dependencyStatus{Status: "up", LatencyMs: time.Since(start).Milliseconds()}
+				if err != nil {
+					st.Status = "down"
+					st.Error = err.Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				statuses[dep.Name] = st
+				if err != nil {
+					ready = false
+				}
+			}(dep)
+		}
+		wg.Wait()
+
+		status := "ready"
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			status = "not-ready"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(struct {
+			Status       string                      `json:"status"`
+			Dependencies map[string]dependencyStatus `json:"dependencies"`
+		}{status, statuses})
+	})
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	IdempotencyHeader = "Idempotency-Key"
+	idempotencyTTL    = 24 * time.Hour
+	// the body is kept in memory to be fingerprinted
+	maxIdempotentBody = 1 << 20
+)
+
+type idempotencyKeyCtx struct{}
+
+type idempotencyScopeCtx struct{}
+
+// idempotentResponse is the recorded outcome of the first request made with
+// a given key. done is closed once the response is available; until then
+// duplicates are answered with 409 and a Retry-After rather than executing
+// twice or holding a connection while the original runs.
+type idempotentResponse struct {
+	fingerprint string
+	expires     time.Time
+	done        chan struct{}
+
+	// attempt counts the runs of the key whose effects were undone, it is
+	// part of the keys derived from it. failed entries are run again by the
+	// next request with the key, renewed ones with a new attempt.
+	attempt int
+	failed  bool
+	renewed bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{entries: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the entry for key and whether the caller owns it, i.e. it is
+// the first request with that key, or the first after one which failed, and
+// must execute and then finish it.
+func (s *IdempotencyStore) begin(key, fingerprint string) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	attempt := 0
+	if e, ok := s.entries[key]; ok {
+		if !e.failed {
+			return e, false
+		}
+		// the downstream services have seen the derived keys with the body of
+		// the failed run already
+		attempt = e.attempt
+		if e.renewed || e.fingerprint != fingerprint {
+			attempt++
+		}
+	}
+
+	e := &idempotentResponse{
+		fingerprint: fingerprint,
+		expires:     now.Add(idempotencyTTL),
+		done:        make(chan struct{}),
+		attempt:     attempt,
+	}
+	s.entries[key] = e
+	return e, true
+}
+
+// finish records the response of the owning request. Server errors are not
+// replayed, a retry with the same key executes again.
+func (s *IdempotencyStore) finish(key string, e *idempotentResponse, rec *responseRecorder) {
+	e.status = rec.status
+	e.header = rec.Header().Clone()
+	e.body = rec.body.Bytes()
+
+	s.mu.Lock()
+	e.failed = rec.status >= http.StatusInternalServerError
+	s.mu.Unlock()
+
+	close(e.done)
+}
+
+// Idempotent deduplicates requests carrying an Idempotency-Key header: the
+// first one is executed and its response stored, later ones get the stored
+// response replayed, or 409 while the first is still running. Reusing a key
+// with a different body is rejected. Keys are told apart by the scope of the
+// request, see WithIdempotencyScope.
+func Idempotent(store *IdempotencyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(IdempotencyHeader)
+		if key == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.String("idempotency.key", key))
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxIdempotentBody))
+		if err != nil {
+			status := http.StatusBadRequest
+			if len(body) >= maxIdempotentBody {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		scoped := key
+		if scope, _ := ctx.Value(idempotencyScopeCtx{}).(string); scope != "" {
+			scoped = scope + "/" + key
+		}
+		e, owner := store.begin(scoped, fingerprint)
+		if !owner {
+			if e.fingerprint != fingerprint {
+				span.AddEvent("idempotency-key-reused", trace.WithAttributes(attribute.String("idempotency.key", key)))
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-e.done:
+			default:
+				span.AddEvent("idempotent-in-progress", trace.WithAttributes(attribute.String("idempotency.key", key)))
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+
+			span.AddEvent("idempotent-replay", trace.WithAttributes(
+				attribute.String("idempotency.key", key),
+				attribute.Int("http.status_code", e.status),
+			))
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			_, _ = w.Write(e.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer store.finish(scoped, e, rec)
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(ctx, idempotencyKeyCtx{}, &idempotentRequest{store, scoped, e})))
+	})
+}
+
+// idempotentRequest is the run of a request with an Idempotency-Key.
+type idempotentRequest struct {
+	store *IdempotencyStore
+	key   string
+	entry *idempotentResponse
+}
+
+// WithIdempotencyScope returns a context whose requests have their
+// Idempotency-Keys kept apart from the ones of other scopes, e.g. of other
+// clients, so that nobody can replay or block a request of somebody else by
+// reusing its key.
+func WithIdempotencyScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, idempotencyScopeCtx{}, scope)
+}
+
+// DerivedIdempotencyKey returns the key to forward to the downstream named
+// scope, derived from the key of the request being handled, or "" if that
+// request had none.
+func DerivedIdempotencyKey(ctx context.Context, scope string) string {
+	r, _ := ctx.Value(idempotencyKeyCtx{}).(*idempotentRequest)
+	if r == nil {
+		return ""
+	}
+	key := r.key
+	if r.entry.attempt > 0 {
+		key += "/" + strconv.Itoa(r.entry.attempt)
+	}
+	sum := sha256.Sum256([]byte(key + "/" + scope))
+	return hex.EncodeToString(sum[:16])
+}
+
+// RenewIdempotencyKeys tells that what the request being handled did
+// downstream was undone, e.g. a payment voided. If it fails, the retry with
+// its key derives new keys instead of having the undone calls replayed.
+func RenewIdempotencyKeys(ctx context.Context) {
+	r, _ := ctx.Value(idempotencyKeyCtx{}).(*idempotentRequest)
+	if r == nil {
+		return
+	}
+	r.store.mu.Lock()
+	r.entry.renewed = true
+	r.store.mu.Unlock()
+}
+
+// responseRecorder passes the response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
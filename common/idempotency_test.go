@@ -0,0 +1,83 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestIdempotencyKeysAreKeptApartByScope sends the same key with the same
+// body for two clients. The second must be run, not be replayed the response
+// of the first.
+func TestIdempotencyKeysAreKeptApartByScope(t *testing.T) {
+	runs := 0
+	h := Idempotent(NewIdempotencyStore(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		runs++
+		_, _ = io.WriteString(w, DerivedIdempotencyKey(req.Context(), "payment"))
+	}))
+
+	derived := make(map[string]bool)
+	for _, client := range []string{"api-key:arman", "api-key:sara", "api-key:arman"} {
+		req := httptest.NewRequest("POST", "/checkout", bytes.NewBufferString(`{"basket":["iPad Air"]}`))
+		req.Header.Set(IdempotencyHeader, "key-1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(WithIdempotencyScope(req.Context(), client)))
+		derived[rec.Body.String()] = true
+	}
+
+	if runs != 2 {
+		t.Errorf("the handler ran %d times, want once for each client", runs)
+	}
+	if len(derived) != 2 {
+		t.Errorf("the clients were given %d derived keys, want one each", len(derived))
+	}
+}
+
+// TestRetryAfterUndoneFailureDerivesNewKeys fails a request once after it
+// undid what it did downstream, and once without. Only the retry of the first
+// may forward new derived keys, the other one has to have the downstream calls
+// replayed.
+func TestRetryAfterUndoneFailureDerivesNewKeys(t *testing.T) {
+	for _, undone := range []bool{true, false} {
+		var derived []string
+		h := Idempotent(NewIdempotencyStore(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			derived = append(derived, DerivedIdempotencyKey(req.Context(), "payment"))
+			if len(derived) == 1 {
+				if undone {
+					RenewIdempotencyKeys(req.Context())
+				}
+				http.Error(w, "shipping failed", http.StatusBadGateway)
+			}
+		}))
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("POST", "/checkout", bytes.NewBufferString(`{"basket":["iPad Air"]}`))
+			req.Header.Set(IdempotencyHeader, "key-1")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		if len(derived) != 2 {
+			t.Fatalf("the handler ran %d times, want the failed request retried", len(derived))
+		}
+		if renewed := derived[0] != derived[1]; renewed != undone {
+			t.Errorf("the retry derived %q after %q, want new keys only after an undone failure", derived[1], derived[0])
+		}
+	}
+}
+
+func TestIdempotentRejectsOversizedBody(t *testing.T) {
+	h := Idempotent(NewIdempotencyStore(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("the handler ran for an oversized body")
+	}))
+
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader(strings.Repeat("a", maxIdempotentBody+1)))
+	req.Header.Set(IdempotencyHeader, "key-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
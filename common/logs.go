@@ -0,0 +1,228 @@
+package common
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+)
+
+// The Go SDK has no logs signal yet, so this file bridges the standard logger
+// into OTLP log records and pushes them to the collector over the same gRPC
+// endpoint used for traces and metrics. The lines logged with Logf carry their
+// level and span as tags, which become the severity and the trace and span
+// ids of the record.
+
+const (
+	logBatchSize     = 256
+	logQueueSize     = 2048
+	logExportPeriod  = 2 * time.Second
+	logExportTimeout = 5 * time.Second
+)
+
+// LogLevel is the level of a line logged with Logf, the lines logged without
+// one are INFO.
+type LogLevel string
+
+const (
+	LevelInfo  LogLevel = "INFO"
+	LevelWarn  LogLevel = "WARN"
+	LevelError LogLevel = "ERROR"
+)
+
+var severities = map[LogLevel]logspb.SeverityNumber{
+	LevelInfo:  logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	LevelWarn:  logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	LevelError: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+}
+
+// logTags matches the tags Logf puts in front of the message.
+var logTags = regexp.MustCompile(`level=(INFO|WARN|ERROR)(?: trace_id=([0-9a-f]{32}) span_id=([0-9a-f]{16}))? `)
+
+// Logf logs a line of level through Logger, tagged with the ids of the span
+// in ctx so the line can be found from its trace and the other way round.
+func Logf(ctx context.Context, level LogLevel, format string, args ...interface{}) {
+	tags := "level=" + string(level)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		tags += " trace_id=" + sc.TraceID().String() + " span_id=" + sc.SpanID().String()
+	}
+	// the caller of Logf is reported as the origin of the line
+	_ = Logger.Output(2, tags+" "+fmt.Sprintf(format, args...))
+}
+
+type LogExporter struct {
+	conn     *grpc.ClientConn
+	client   collogspb.LogsServiceClient
+	resource *resourcepb.Resource
+	scope    *commonpb.InstrumentationLibrary
+
+	records chan *logspb.LogRecord
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewLogExporter dials the collector with opts, which must include the
+// transport credentials, and starts the background batcher. The returned
+// exporter is an io.Writer so it can be plugged into log.Logger.
+func NewLogExporter(ctx context.Context, endpoint string, res *resource.Resource, opts ...grpc.DialOption) (*LogExporter, error) {
+	conn, err := grpc.DialContext(ctx, endpoint, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &LogExporter{
+		conn:     conn,
+		client:   collogspb.NewLogsServiceClient(conn),
+		resource: &resourcepb.Resource{Attributes: keyValues(res.Attributes())},
+		scope:    &commonpb.InstrumentationLibrary{Name: "log"},
+		records:  make(chan *logspb.LogRecord, logQueueSize),
+		stop:     make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e, nil
+}
+
+// Write turns one formatted log line into a log record, the tags of Logf are
+// taken out of the body into the severity and the span of the record. It
+// never blocks the caller; records are dropped if the queue is full.
+func (e *LogExporter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	level := LevelInfo
+	var traceID, spanID []byte
+	if m := logTags.FindStringSubmatchIndex(line); m != nil {
+		level = LogLevel(line[m[2]:m[3]])
+		if m[4] >= 0 {
+			traceID, _ = hex.DecodeString(line[m[4]:m[5]])
+			spanID, _ = hex.DecodeString(line[m[6]:m[7]])
+		}
+		line = line[:m[0]] + line[m[1]:]
+	}
+
+	record := &logspb.LogRecord{
+		TimeUnixNano:   uint64(time.Now().UnixNano()),
+		SeverityNumber: severities[level],
+		SeverityText:   string(level),
+		TraceId:        traceID,
+		SpanId:         spanID,
+		Body: &commonpb.AnyValue{
+			Value: &commonpb.AnyValue_StringValue{StringValue: line},
+		},
+	}
+
+	select {
+	case e.records <- record:
+	default:
+	}
+
+	return len(p), nil
+}
+
+func (e *LogExporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(logExportPeriod)
+	defer ticker.Stop()
+
+	batch := make([]*logspb.LogRecord, 0, logBatchSize)
+	for {
+		select {
+		case r := <-e.records:
+			batch = append(batch, r)
+			if len(batch) >= logBatchSize {
+				batch = e.export(batch)
+			}
+		case <-ticker.C:
+			batch = e.export(batch)
+		case <-e.stop:
+			for {
+				select {
+				case r := <-e.records:
+					batch = append(batch, r)
+				default:
+					e.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *LogExporter) export(batch []*logspb.LogRecord) []*logspb.LogRecord {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logExportTimeout)
+	defer cancel()
+
+	_, err := e.client.Export(ctx, &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: e.resource,
+			InstrumentationLibraryLogs: []*logspb.InstrumentationLibraryLogs{{
+				InstrumentationLibrary: e.scope,
+				Logs:                   batch,
+			}},
+		}},
+	})
+	if err != nil {
+		otel.Handle(err)
+	}
+	TelemetryHealth.report("logs", err)
+
+	return batch[:0]
+}
+
+// Shutdown flushes the queued records and closes the connection.
+func (e *LogExporter) Shutdown(ctx context.Context) error {
+	close(e.stop)
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	return e.conn.Close()
+}
+
+func keyValues(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		kvs = append(kvs, &commonpb.KeyValue{Key: string(kv.Key), Value: anyValue(kv.Value)})
+	}
+	return kvs
+}
+
+func anyValue(v attribute.Value) *commonpb.AnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.AsBool()}}
+	case attribute.INT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.AsInt64()}}
+	case attribute.FLOAT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.AsFloat64()}}
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.Emit()}}
+	}
+}
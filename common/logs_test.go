@@ -0,0 +1,54 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// TestLogRecordsCarryLevelAndSpan logs an error within a span and a plain
+// line through the exporter. The error must become an ERROR record of the
+// span, without the tags in its body, and the plain line an INFO record of no
+// span.
+func TestLogRecordsCarryLevelAndSpan(t *testing.T) {
+	e := &LogExporter{records: make(chan *logspb.LogRecord, 2)}
+	var stderr bytes.Buffer
+	defer func(l *log.Logger) { Logger = l }(Logger)
+	Logger = log.New(&stderr, "[test] ", log.Lshortfile)
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0xab, 1},
+		SpanID:     trace.SpanID{0xcd, 2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	Logf(trace.ContextWithSpanContext(context.Background(), sc), LevelError, "Failed to capture %s\n", "PAYPAL-1")
+	Logger.Printf("Listening on port 80\n")
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(stderr.String(), "\n"), "\n") {
+		if _, err := e.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failed, plain := <-e.records, <-e.records
+	if failed.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_ERROR || failed.SeverityText != "ERROR" {
+		t.Errorf("the error was logged as %v %q, want ERROR", failed.SeverityNumber, failed.SeverityText)
+	}
+	if traceID := sc.TraceID(); !bytes.Equal(failed.TraceId, traceID[:]) {
+		t.Errorf("the error is of trace %x, want %v", failed.TraceId, sc.TraceID())
+	}
+	if spanID := sc.SpanID(); !bytes.Equal(failed.SpanId, spanID[:]) {
+		t.Errorf("the error is of span %x, want %v", failed.SpanId, sc.SpanID())
+	}
+	if body := failed.Body.GetStringValue(); strings.Contains(body, "level=") || !strings.HasSuffix(body, ": Failed to capture PAYPAL-1") || !strings.Contains(body, "logs_test.go:") {
+		t.Errorf("the error reads %q, want the line of the caller without the tags", body)
+	}
+
+	if plain.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_INFO || plain.TraceId != nil {
+		t.Errorf("the plain line was logged as %v of trace %x, want INFO of none", plain.SeverityNumber, plain.TraceId)
+	}
+}
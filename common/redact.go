@@ -0,0 +1,195 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Personal and payment data must not leave the service through telemetry.
+// The same rules are applied to span and event attributes before they reach
+// the exporter and to every line written by the Logger.
+//
+// Rules are configured with REDACT_RULES as a comma separated list of
+// key:action pairs, e.g. "name:hash,address:mask,products:drop". Keys are
+// matched case-insensitively against attribute keys and against the field
+// names found in log lines (JSON, %+v structs, header maps and key=value).
+//
+//	mask  replaces the value with ****
+//	hash  replaces the value with a short SHA-256 so it can still be correlated
+//	drop  removes the attribute, or replaces the value with [REDACTED] in logs
+const defaultRedactRules = "name:hash,address:mask,email:hash,basket:hash,products:hash,number:mask,cvv:drop,expiry:mask,authorization:mask,cookie:mask,set-cookie:mask"
+
+type redactAction string
+
+const (
+	redactMask redactAction = "mask"
+	redactHash redactAction = "hash"
+	redactDrop redactAction = "drop"
+)
+
+type redactRule struct {
+	key     string
+	action  redactAction
+	logExps []*regexp.Regexp
+}
+
+var redactRules = loadRedactRules(getenv("REDACT_RULES", defaultRedactRules))
+
+func loadRedactRules(config string) map[string]*redactRule {
+	rules := make(map[string]*redactRule)
+	for _, pair := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		key := strings.ToLower(parts[0])
+		action := redactAction(strings.ToLower(parts[1]))
+		if action != redactMask && action != redactHash && action != redactDrop {
+			continue
+		}
+
+		k := regexp.QuoteMeta(key)
+		rules[key] = &redactRule{
+			key:    key,
+			action: action,
+			logExps: []*regexp.Regexp{
+				// "key": "value"
+				regexp.MustCompile(`("(?i:` + k + `)"\s*:\s*")((?:[^"\\]|\\.)*)(")`),
+				// Key:[value] as printed for slices and header maps
+				regexp.MustCompile(`(\b(?i:` + k + `):\[)([^\]]*)(\])`),
+				// Key:value as printed by %+v, up to the next field or the end of the struct
+				regexp.MustCompile(`(?m)(\b(?i:` + k + `):)([^\[{].*?)(\s[A-Z][\w-]*:|}|$)`),
+				// key=value
+				regexp.MustCompile(`(\b(?i:` + k + `)=)(\S+)()`),
+			},
+		}
+	}
+	return rules
+}
+
+func (r *redactRule) apply(value string) string {
+	switch r.action {
+	case redactHash:
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case redactDrop:
+		return "[REDACTED]"
+	default:
+		return "****"
+	}
+}
+
+// redactAttributes returns attrs with the rules applied, it allocates only
+// when something has to be redacted.
+func redactAttributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	var out []attribute.KeyValue
+	for i, kv := range attrs {
+		rule, ok := redactRules[strings.ToLower(string(kv.Key))]
+		if !ok {
+			if out != nil {
+				out = append(out, kv)
+			}
+			continue
+		}
+		if out == nil {
+			out = append(make([]attribute.KeyValue, 0, len(attrs)), attrs[:i]...)
+		}
+
+		switch {
+		case rule.action == redactDrop:
+		case kv.Value.Type() == attribute.STRINGSLICE:
+			// AsStringSlice shares its backing array with the span, never modify it
+			values := make([]string, 0, len(kv.Value.AsStringSlice()))
+			for _, v := range kv.Value.AsStringSlice() {
+				values = append(values, rule.apply(v))
+			}
+			out = append(out, kv.Key.StringSlice(values))
+		default:
+			out = append(out, kv.Key.String(rule.apply(kv.Value.Emit())))
+		}
+	}
+	if out == nil {
+		return attrs
+	}
+	return out
+}
+
+// redactingProcessor hands ended spans to the next processor with the span
+// and event attributes redacted.
+type redactingProcessor struct {
+	next sdktrace.SpanProcessor
+}
+
+func NewRedactingProcessor(next sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	return &redactingProcessor{next: next}
+}
+
+func (p *redactingProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	p.next.OnStart(parent, s)
+}
+
+func (p *redactingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	events := s.Events()
+	redacted := make([]sdktrace.Event, len(events))
+	for i, e := range events {
+		e.Attributes = redactAttributes(e.Attributes)
+		redacted[i] = e
+	}
+
+	p.next.OnEnd(&redactedSpan{
+		ReadOnlySpan: s,
+		attributes:   redactAttributes(s.Attributes()),
+		events:       redacted,
+	})
+}
+
+func (p *redactingProcessor) Shutdown(ctx context.Context) error {
+	return p.next.Shutdown(ctx)
+}
+
+func (p *redactingProcessor) ForceFlush(ctx context.Context) error {
+	return p.next.ForceFlush(ctx)
+}
+
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	attributes []attribute.KeyValue
+	events     []sdktrace.Event
+}
+
+func (s *redactedSpan) Attributes() []attribute.KeyValue { return s.attributes }
+func (s *redactedSpan) Events() []sdktrace.Event         { return s.events }
+
+// redactingWriter is the logger hook, it applies the rules to each line before
+// passing it on.
+type redactingWriter struct {
+	next io.Writer
+}
+
+func NewRedactingWriter(next io.Writer) io.Writer {
+	return &redactingWriter{next: next}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	line := string(p)
+	for _, rule := range redactRules {
+		for _, exp := range rule.logExps {
+			line = exp.ReplaceAllStringFunc(line, func(m string) string {
+				g := exp.FindStringSubmatch(m)
+				return g[1] + rule.apply(g[2]) + g[3]
+			})
+		}
+	}
+
+	if _, err := io.WriteString(w.next, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,287 @@
+package common
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy sends a request up to maxAttempts times, waiting a random delay
+// of up to baseDelay doubled with every attempt (capped at maxDelay) in
+// between. Only requests which are safe to repeat are retried, i.e. carrying
+// an Idempotency-Key or made with an idempotent method, and only on connection
+// errors, 429 and 5xx answers, and on the 409 of a duplicate whose original is
+// still in progress. With a HedgeDelay, a second attempt is started when the
+// first did not answer within it and the first good answer is used. The hedge
+// carries the same Idempotency-Key, so it only wins over a first attempt lost
+// or held up on its way; once that reached the downstream, the hedge is
+// answered 409 and the answer of the first is waited for.
+type RetryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	HedgeDelay  time.Duration
+}
+
+// NewRetryPolicy is configured by RETRY_MAX_ATTEMPTS (3 by default, 1
+// disables retries), RETRY_BASE_DELAY (100ms) and RETRY_MAX_DELAY (2s).
+func NewRetryPolicy() RetryPolicy {
+	p := RetryPolicy{
+		maxAttempts: 3,
+		baseDelay:   100 * time.Millisecond,
+		maxDelay:    2 * time.Second,
+	}
+	if n, err := strconv.Atoi(getenv("RETRY_MAX_ATTEMPTS", "")); err == nil && n > 0 {
+		p.maxAttempts = n
+	}
+	if d, err := time.ParseDuration(getenv("RETRY_BASE_DELAY", "")); err == nil && d > 0 {
+		p.baseDelay = d
+	}
+	if d, err := time.ParseDuration(getenv("RETRY_MAX_DELAY", "")); err == nil && d > 0 {
+		p.maxDelay = d
+	}
+	return p
+}
+
+// Do sends req to downstream following the policy. Every attempt is a client
+// span of its own with the number of the resend as http.resend_count, and
+// goes through the circuit breaker of downstream and passes on the budget
+// left. The body of req must be
+// replayable, as it is for the bodies of http.NewRequest.
+func (p RetryPolicy) Do(ctx context.Context, client *http.Client, downstream string, req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(ctx)
+	retryable := isIdempotent(req)
+
+	for n := 0; ; n++ {
+		if n > 0 {
+			delay := p.backoff(n)
+			span.AddEvent("Retrying "+downstream, trace.WithAttributes(
+				attribute.Int("http.resend_count", n),
+				attribute.Int64("delay-ms", delay.Milliseconds()),
+			))
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+
+		var res *http.Response
+		var err error
+		if p.HedgeDelay > 0 && retryable {
+			res, err = p.hedged(ctx, client, downstream, req, n)
+		} else {
+			res, err = p.attempt(ctx, client, downstream, req, n, false)
+		}
+
+		if !retryable || n+1 >= p.maxAttempts || !shouldRetry(ctx, res, err) {
+			return res, err
+		}
+		if res != nil {
+			drain(res)
+		}
+	}
+}
+
+// backoff returns the delay before the resend n, with full jitter.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.maxDelay
+	if n < 32 && p.baseDelay<<uint(n-1) < p.maxDelay {
+		d = p.baseDelay << uint(n-1)
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// hedged runs the attempt n and, if it did not answer within HedgeDelay, a
+// second one in parallel. The first good answer is returned and the other
+// attempt is cancelled.
+func (p RetryPolicy) hedged(ctx context.Context, client *http.Client, downstream string, req *http.Request, n int) (*http.Response, error) {
+	type result struct {
+		res    *http.Response
+		err    error
+		cancel context.CancelFunc
+	}
+	// buffered, so the attempts never block on the results nobody waits for
+	results := make(chan result, 2)
+	launch := func(hedge bool) {
+		actx, cancel := context.WithCancel(ctx)
+		go func() {
+			res, err := p.attempt(actx, client, downstream, req, n, hedge)
+			results <- result{res: res, err: err, cancel: cancel}
+		}()
+	}
+
+	launch(false)
+	pending, hedgedAlready := 1, false
+	timer := time.NewTimer(p.HedgeDelay)
+	defer timer.Stop()
+
+	var last result
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !hedgedAlready {
+				trace.SpanFromContext(ctx).AddEvent("Hedging "+downstream, trace.WithAttributes(
+					attribute.Int64("hedge-delay-ms", p.HedgeDelay.Milliseconds()),
+				))
+				launch(true)
+				pending++
+				hedgedAlready = true
+			}
+			continue
+		case last = <-results:
+			pending--
+		}
+
+		if !shouldRetry(ctx, last.res, last.err) || pending == 0 {
+			break
+		}
+		// wait for the other attempt, it may still answer well
+		if last.res != nil {
+			drain(last.res)
+		}
+		last.cancel()
+	}
+
+	// the attempts still running lost, they are cancelled and cleaned up
+	if pending > 0 {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				r := <-results
+				r.cancel()
+				if r.res != nil {
+					drain(r.res)
+				}
+			}
+		}(pending)
+	}
+	if last.res == nil {
+		last.cancel()
+		return nil, last.err
+	}
+	last.res.Body = cancelOnClose{ReadCloser: last.res.Body, cancel: last.cancel}
+	return last.res, last.err
+}
+
+// attempt sends req once, in a client span of its own.
+func (p RetryPolicy) attempt(ctx context.Context, client *http.Client, downstream string, req *http.Request, n int, hedge bool) (*http.Response, error) {
+	ctx, span := otel.Tracer("http-client-tracer").Start(ctx, fmt.Sprintf("HTTP %s %s", req.Method, downstream),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+			semconv.PeerServiceKey.String(downstream),
+			attribute.Int("http.resend_count", n),
+		),
+	)
+	defer span.End()
+	if hedge {
+		span.SetAttributes(attribute.Bool("http.hedged", true))
+	}
+
+	r := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+
+	done, err := Breakers.Get(downstream).Allow(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	SetBudget(ctx, r)
+	otelhttptrace.Inject(ctx, r,
+		// It seems otelhttptrace.W3C didn't consider global propagator, so you must explecitly inject
+		otelhttptrace.WithPropagators(otel.GetTextMapPropagator()),
+	)
+
+	res, err := client.Do(r)
+	done(err != nil || res.StatusCode >= http.StatusInternalServerError)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+	if res.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, res.Status)
+	}
+	return res, nil
+}
+
+// RandomIdempotencyKey returns a new key for a call made without one.
+func RandomIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isIdempotent reports whether sending req more than once has the same effect
+// as sending it once.
+func isIdempotent(req *http.Request) bool {
+	if req.Header.Get(IdempotencyHeader) != "" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// shouldRetry reports whether the outcome of an attempt is worth another one.
+func shouldRetry(ctx context.Context, res *http.Response, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError || inProgress(res)
+}
+
+// inProgress reports whether res is the answer of Idempotent to a duplicate
+// whose original is still running.
+func inProgress(res *http.Response) bool {
+	return res.StatusCode == http.StatusConflict && res.Header.Get("Retry-After") != ""
+}
+
+// drain reads the rest of the body, so the connection can be reused.
+func drain(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+}
+
+// cancelOnClose releases the context of the winning hedged attempt once its
+// body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// carrier is a downstream deduplicating its requests, which takes delay to
+// answer the first of them.
+func carrier(t *testing.T, delay time.Duration) (*httptest.Server, *int32) {
+	var handled int32
+	srv := httptest.NewServer(Idempotent(NewIdempotencyStore(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&handled, 1) == 1 {
+			time.Sleep(delay)
+		}
+		_, _ = io.WriteString(w, "shipped")
+	})))
+	t.Cleanup(srv.Close)
+	return srv, &handled
+}
+
+func hedgedRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(`{"address":"24 Ferdowsi St"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(IdempotencyHeader, RandomIdempotencyKey())
+	return req
+}
+
+// TestHedgeBeatsFirstAttemptHeldUpOnItsWay holds the first attempt up before
+// it reaches the carrier. The hedge must get through and answer long before.
+func TestHedgeBeatsFirstAttemptHeldUpOnItsWay(t *testing.T) {
+	srv, handled := carrier(t, 0)
+
+	var sent int32
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&sent, 1) == 1 {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	p := RetryPolicy{maxAttempts: 1, HedgeDelay: 20 * time.Millisecond}
+	start := time.Now()
+	res, err := p.Do(context.Background(), client, "hedge-in-transit", hedgedRequest(t, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Do() took %v, the hedge should have answered", elapsed)
+	}
+	if res.StatusCode != http.StatusOK || string(body) != "shipped" {
+		t.Errorf("Do() = %d %q, want 200 shipped", res.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(handled); n != 1 {
+		t.Errorf("the carrier handled %d requests, want 1", n)
+	}
+}
+
+// TestHedgeWaitsForSlowCarrier lets the first attempt reach a carrier which is
+// slow to answer. The hedge is answered 409 right away without running the
+// request again, and the answer of the first attempt is returned.
+func TestHedgeWaitsForSlowCarrier(t *testing.T) {
+	srv, handled := carrier(t, 200*time.Millisecond)
+
+	p := RetryPolicy{maxAttempts: 1, HedgeDelay: 20 * time.Millisecond}
+	res, err := p.Do(context.Background(), srv.Client(), "hedge-slow-carrier", hedgedRequest(t, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || string(body) != "shipped" {
+		t.Errorf("Do() = %d %q, want 200 shipped", res.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(handled); n != 1 {
+		t.Errorf("the carrier handled %d requests, want 1", n)
+	}
+}
+
+func TestIdempotentAnswersDuplicateInProgress(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := Idempotent(NewIdempotencyStore(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	}))
+
+	newReq := func(body string) *http.Request {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.Header.Set(IdempotencyHeader, "key-1")
+		return req
+	}
+
+	first := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		h.ServeHTTP(first, newReq("a"))
+		close(finished)
+	}()
+	<-started
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"same request in progress", "a", http.StatusConflict},
+		{"key reused with another body", "b", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newReq(tt.body))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusConflict && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+
+	close(release)
+	<-finished
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newReq("a"))
+	if rec.Code != http.StatusOK || rec.Body.String() != "done" || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay = %d %q, want the stored 200 done", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+)
+
+// Serve runs srv until SIGINT or SIGTERM is received, then stops accepting
+// connections and waits for the in-flight requests to finish. The wait is
+// bounded by SHUTDOWN_TIMEOUT (5s by default, which leaves time to flush the
+// telemetry before docker kills the container after 10s). serve only returns
+// once the server is stopped, so the deferred shutdown of the providers in
+// main still runs and exports what is buffered.
+func Serve(srv *http.Server) error {
+	var inflight int64
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&inflight, 1)
+		defer atomic.AddInt64(&inflight, -1)
+		handler.ServeHTTP(w, req)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificates are part of srv.TLSConfig already
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// restore the default behaviour, a second signal kills the process
+	stop()
+
+	timeout := ShutdownTimeout()
+	pending := atomic.LoadInt64(&inflight)
+	Logger.Printf("Shutting down, draining %d in-flight requests within %v\n", pending, timeout)
+
+	start := time.Now()
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	outcome := "drained"
+	err := srv.Shutdown(drainCtx)
+	aborted := atomic.LoadInt64(&inflight)
+	if err != nil {
+		outcome = "timed-out"
+		// cut the connections of the requests which did not make it in time
+		_ = srv.Close()
+	}
+	elapsed := time.Since(start)
+
+	if err != nil {
+		Logf(context.Background(), LevelWarn, "Drain timed out after %v, aborted %d of %d in-flight requests\n", elapsed, aborted, pending)
+	} else {
+		Logger.Printf("Drained %d in-flight requests in %v\n", pending, elapsed)
+	}
+	recordDrain(elapsed, pending, aborted, outcome)
+
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ShutdownTimeout is how long a stopping service waits for the in-flight
+// requests, SHUTDOWN_TIMEOUT (5s by default).
+func ShutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(getenv("SHUTDOWN_TIMEOUT", "5s"))
+	if err != nil || timeout <= 0 {
+		return 5 * time.Second
+	}
+	return timeout
+}
+
+// recordDrain reports the drain, the instruments are pushed with the last
+// collection when the meter provider is stopped.
+func recordDrain(elapsed time.Duration, pending, aborted int64, outcome string) {
+	meter := global.Meter("server-meter")
+	labels := []attribute.KeyValue{attribute.String("outcome", outcome)}
+
+	metric.Must(meter).
+		NewFloat64Histogram(
+			"server/drain_duration",
+			metric.WithDescription("The time it took to drain the in-flight requests on shutdown"),
+			metric.WithUnit("ms"),
+		).Record(context.Background(), float64(elapsed.Microseconds())/1000, labels...)
+	metric.Must(meter).
+		NewInt64Counter(
+			"server/drain_inflight_requests",
+			metric.WithDescription("The number of requests in flight when the shutdown started"),
+		).Add(context.Background(), pending, labels...)
+	metric.Must(meter).
+		NewInt64Counter(
+			"server/drain_aborted_requests",
+			metric.WithDescription("The number of in-flight requests aborted by the shutdown deadline"),
+		).Add(context.Background(), aborted, labels...)
+}
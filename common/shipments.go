@@ -0,0 +1,296 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// shipmentRetention is how long a shipment is kept once the back-end was
+// notified of its delivery.
+const shipmentRetention = 24 * time.Hour
+
+var ErrShipmentNotFound = errors.New("shipment not found")
+
+// lifecycle is the simulated journey of every shipment, each status is
+// reached once the given (simulated) time has passed since the label was
+// created.
+var lifecycle = []struct {
+	Status string
+	After  time.Duration
+}{
+	{"label-created", 0},
+	{"picked-up", 2 * time.Hour},
+	{"in-transit", 6 * time.Hour},
+	{"delivered", 48 * time.Hour},
+}
+
+// delivered is the last status of the lifecycle.
+var delivered = lifecycle[len(lifecycle)-1].Status
+
+// ShipmentClock drives the lifecycle, running SHIPMENT_CLOCK_SPEED times
+// faster than the wall clock so a delivery can be watched within minutes.
+type ShipmentClock struct {
+	now   func() time.Time
+	speed float64
+}
+
+func NewShipmentClock() ShipmentClock {
+	speed, err := strconv.ParseFloat(getenv("SHIPMENT_CLOCK_SPEED", "360"), 64)
+	if err != nil || speed <= 0 {
+		speed = 360
+	}
+	return ShipmentClock{now: time.Now, speed: speed}
+}
+
+// elapsed returns the simulated time passed since t.
+func (c ShipmentClock) elapsed(t time.Time) time.Duration {
+	return time.Duration(float64(c.now().Sub(t)) * c.speed)
+}
+
+// at returns the wall clock time at which the simulated duration d has
+// passed since t.
+func (c ShipmentClock) at(t time.Time, d time.Duration) time.Time {
+	return t.Add(time.Duration(float64(d) / c.speed))
+}
+
+type Shipment struct {
+	TrackingNumber string    `json:"tracking-number"`
+	Address        string    `json:"address"`
+	Basket         []string  `json:"basket"`
+	CreatedAt      time.Time `json:"created-at"`
+
+	// the span which created the shipment, webhooks link back to it
+	TraceID string `json:"trace-id"`
+	SpanID  string `json:"span-id"`
+	// the last status the back-end was notified about, and when
+	Notified   string    `json:"notified,omitempty"`
+	NotifiedAt time.Time `json:"notified-at,omitempty"`
+}
+
+// Origin returns the span context of the span which created the shipment.
+func (s Shipment) Origin() trace.SpanContext {
+	traceID, _ := trace.TraceIDFromHex(s.TraceID)
+	spanID, _ := trace.SpanIDFromHex(s.SpanID)
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+}
+
+type ShipmentEvent struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+type ShipmentStatus struct {
+	TrackingNumber    string          `json:"tracking-number"`
+	Carrier           string          `json:"carrier"`
+	Status            string          `json:"status"`
+	History           []ShipmentEvent `json:"history"`
+	EstimatedDelivery time.Time       `json:"estimated-delivery"`
+}
+
+// Status reports where the shipment is in its lifecycle according to clock.
+func (s Shipment) Status(carrier string, clock ShipmentClock) ShipmentStatus {
+	elapsed := clock.elapsed(s.CreatedAt)
+
+	st := ShipmentStatus{
+		TrackingNumber:    s.TrackingNumber,
+		Carrier:           carrier,
+		EstimatedDelivery: clock.at(s.CreatedAt, lifecycle[len(lifecycle)-1].After),
+	}
+	for _, stage := range lifecycle {
+		if elapsed < stage.After {
+			break
+		}
+		st.Status = stage.Status
+		st.History = append(st.History, ShipmentEvent{stage.Status, clock.at(s.CreatedAt, stage.After)})
+	}
+	return st
+}
+
+// Unnotified returns the statuses the shipment reached according to clock
+// which the back-end was not notified about yet, oldest first.
+func (s Shipment) Unnotified(clock ShipmentClock) []ShipmentEvent {
+	history := s.Status("", clock).History
+	for i, e := range history {
+		if e.Status == s.Notified {
+			return history[i+1:]
+		}
+	}
+	return history
+}
+
+// ShipmentStore keeps the shipments in memory and writes them through to a
+// JSON file, so tracking numbers stay valid across restarts. The shipments
+// whose delivery was not notified yet are indexed, the webhooks only ever
+// look at those, and the others are pruned a while after.
+type ShipmentStore struct {
+	mu                sync.Mutex
+	path              string
+	newTrackingNumber func() (string, error)
+	shipments         map[string]*Shipment
+	pending           map[string]*Shipment
+}
+
+// NewShipmentStore loads the shipments of the file at path. New shipments
+// are numbered by newTrackingNumber, in the format of the carrier.
+func NewShipmentStore(path string, newTrackingNumber func() (string, error)) (*ShipmentStore, error) {
+	s := &ShipmentStore{
+		path:              path,
+		newTrackingNumber: newTrackingNumber,
+		shipments:         make(map[string]*Shipment),
+		pending:           make(map[string]*Shipment),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.shipments); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	for tracking, sh := range s.shipments {
+		if sh.Notified != delivered {
+			s.pending[tracking] = sh
+		}
+	}
+	return s, nil
+}
+
+// Create stores a new shipment under a new tracking number, retrying on the
+// unlikely collision.
+func (s *ShipmentStore) Create(address string, basket []string, origin trace.SpanContext, now time.Time) (Shipment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tracking string
+	for {
+		var err error
+		if tracking, err = s.newTrackingNumber(); err != nil {
+			return Shipment{}, err
+		}
+		if _, ok := s.shipments[tracking]; !ok {
+			break
+		}
+	}
+
+	sh := &Shipment{
+		TrackingNumber: tracking,
+		Address:        address,
+		Basket:         basket,
+		CreatedAt:      now.UTC(),
+		TraceID:        origin.TraceID().String(),
+		SpanID:         origin.SpanID().String(),
+	}
+	s.shipments[tracking] = sh
+	s.pending[tracking] = sh
+
+	return *sh, s.save()
+}
+
+func (s *ShipmentStore) Get(tracking string) (Shipment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sh, ok := s.shipments[tracking]
+	if !ok {
+		return Shipment{}, ErrShipmentNotFound
+	}
+	return *sh, nil
+}
+
+// Pending returns the shipments whose delivery the back-end was not notified
+// about yet.
+func (s *ShipmentStore) Pending() []Shipment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make([]Shipment, 0, len(s.pending))
+	for _, sh := range s.pending {
+		pending = append(pending, *sh)
+	}
+	return pending
+}
+
+func (s *ShipmentStore) MarkNotified(tracking, status string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sh, ok := s.shipments[tracking]
+	if !ok {
+		return ErrShipmentNotFound
+	}
+	sh.Notified = status
+	sh.NotifiedAt = now.UTC()
+	if status == delivered {
+		delete(s.pending, tracking)
+	}
+	return s.save()
+}
+
+// Prune drops the shipments whose delivery was notified more than a day
+// before now.
+func (s *ShipmentStore) Prune(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pruned := false
+	for tracking, sh := range s.shipments {
+		if sh.Notified == delivered && now.Sub(sh.NotifiedAt) > shipmentRetention {
+			delete(s.shipments, tracking)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the whole store to a temporary file and renames it over the
+// previous one, so a crash never leaves a truncated file behind.
+func (s *ShipmentStore) save() error {
+	data, err := json.MarshalIndent(s.shipments, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// RandomDigits returns n random decimal digits.
+func RandomDigits(n int) (string, error) {
+	b := make([]byte, n)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
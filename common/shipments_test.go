@@ -0,0 +1,100 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func sequentialTrackingNumbers() func() (string, error) {
+	n := 0
+	return func() (string, error) {
+		n++
+		return fmt.Sprintf("TL%08dAU", n), nil
+	}
+}
+
+// TestShipmentReportsWhatWasNotNotifiedYet lets the simulated clock run past
+// the pick-up of a shipment. Only the statuses reached since the last one the
+// back-end was notified about may be reported, in the order they happened.
+func TestShipmentReportsWhatWasNotNotifiedYet(t *testing.T) {
+	created := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	now := created.Add(3 * time.Hour)
+	clock := ShipmentClock{now: func() time.Time { return now }, speed: 1}
+	sh := Shipment{TrackingNumber: "TL123456785AU", CreatedAt: created}
+
+	if got := sh.Status("TOLL", clock).Status; got != "picked-up" {
+		t.Errorf("status after 3h is %s, want picked-up", got)
+	}
+	if got := sh.Unnotified(clock); len(got) != 2 || got[0].Status != "label-created" || got[1].Status != "picked-up" {
+		t.Errorf("unnotified after 3h are %+v, want label-created and picked-up", got)
+	}
+
+	sh.Notified = "label-created"
+	now = created.Add(50 * time.Hour)
+	got := sh.Unnotified(clock)
+	if len(got) != 3 || got[0].Status != "picked-up" || got[2].Status != delivered {
+		t.Errorf("unnotified after the delivery are %+v, want picked-up, in-transit and delivered", got)
+	}
+	if want := created.Add(48 * time.Hour); len(got) == 3 && !got[2].Time.Equal(want) {
+		t.Errorf("delivered at %v, want %v", got[2].Time, want)
+	}
+}
+
+// TestDeliveredShipmentsArePruned notifies the delivery of one of two
+// shipments. It leaves the pending shipments right away and is dropped a day
+// later, also from the file the store is opened again with.
+func TestDeliveredShipmentsArePruned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shipments.json")
+	store, err := NewShipmentStore(path, sequentialTrackingNumbers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	done, err := store.Create("24 Ferdowsi St", []string{"iPad Air"}, trace.SpanContext{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moving, err := store.Create("24 Ferdowsi St", []string{"Pixel 6"}, trace.SpanContext{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.MarkNotified(done.TrackingNumber, delivered, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkNotified(moving.TrackingNumber, "in-transit", now); err != nil {
+		t.Fatal(err)
+	}
+	if pending := store.Pending(); len(pending) != 1 || pending[0].TrackingNumber != moving.TrackingNumber {
+		t.Errorf("pending are %+v, want only %s", pending, moving.TrackingNumber)
+	}
+
+	if err := store.Prune(now.Add(23 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(done.TrackingNumber); err != nil {
+		t.Errorf("the delivered shipment is gone within a day: %v", err)
+	}
+	if err := store.Prune(now.Add(25 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(done.TrackingNumber); !errors.Is(err, ErrShipmentNotFound) {
+		t.Errorf("getting the delivered shipment a day later returned %v, want %v", err, ErrShipmentNotFound)
+	}
+
+	store, err = NewShipmentStore(path, sequentialTrackingNumbers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(done.TrackingNumber); !errors.Is(err, ErrShipmentNotFound) {
+		t.Errorf("the pruned shipment is back after a restart")
+	}
+	if pending := store.Pending(); len(pending) != 1 || pending[0].Notified != "in-transit" {
+		t.Errorf("pending after a restart are %+v, want %s notified in-transit", pending, moving.TrackingNumber)
+	}
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/metric"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+)
+
+// CollectorDialOptions never block on the collector: the connection is made
+// in the background and re-established with exponential backoff, so the
+// service serves traffic even while the collector is down. The connection is
+// secured with TLS if OTLP_TLS is set.
+func CollectorDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(ServiceTLS.collectorCredentials()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  time.Second,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   15 * time.Second,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+	}
+}
+
+// ExportHealth follows the outcome of the exports of every signal. The state
+// changes are logged and the state is observed as metrics, which reach the
+// backends again once the collector is back.
+type ExportHealth struct {
+	mu      sync.Mutex
+	signals map[string]*signalHealth
+	buffers []*diskQueue
+}
+
+type signalHealth struct {
+	healthy  bool
+	failures int64
+	since    time.Time
+}
+
+var TelemetryHealth = &ExportHealth{signals: make(map[string]*signalHealth)}
+
+// report records the outcome of one export of signal.
+func (h *ExportHealth) report(signal string, err error) {
+	h.mu.Lock()
+	st, ok := h.signals[signal]
+	if !ok {
+		st = &signalHealth{healthy: true, since: time.Now()}
+		h.signals[signal] = st
+	}
+	changed := st.healthy != (err == nil)
+	if err != nil {
+		st.failures++
+	}
+	if changed {
+		st.healthy = err == nil
+		st.since = time.Now()
+	}
+	failures := st.failures
+	h.mu.Unlock()
+
+	// logged outside the lock, the log exporter reports to h as well
+	switch {
+	case changed && err != nil:
+		Logf(context.Background(), LevelWarn, "Telemetry %s export failing, retrying in the background: %v\n", signal, err)
+	case changed:
+		Logger.Printf("Telemetry %s export recovered, %d failed exports so far\n", signal, failures)
+	}
+}
+
+// addBuffer adds the disk queue of a signal to the observed state.
+func (h *ExportHealth) addBuffer(q *diskQueue) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buffers = append(h.buffers, q)
+}
+
+// RegisterMetrics observes the export health with meter.
+func (h *ExportHealth) RegisterMetrics(meter metric.Meter) {
+	observe := func(value func(*signalHealth) int64) func(context.Context, metric.Int64ObserverResult) {
+		return func(_ context.Context, result metric.Int64ObserverResult) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			for signal, st := range h.signals {
+				result.Observe(value(st), attribute.String("signal", signal))
+			}
+		}
+	}
+
+	metric.Must(meter).
+		NewInt64GaugeObserver(
+			"telemetry/export_healthy",
+			observe(func(st *signalHealth) int64 {
+				if st.healthy {
+					return 1
+				}
+				return 0
+			}),
+			metric.WithDescription("Whether the last export of the signal to the collector succeeded"),
+		)
+	metric.Must(meter).
+		NewInt64CounterObserver(
+			"telemetry/export_failures",
+			observe(func(st *signalHealth) int64 { return st.failures }),
+			metric.WithDescription("The number of failed exports of the signal to the collector"),
+		)
+
+	observeBuffers := func(value func(dropped, replayed, size int64) int64) func(context.Context, metric.Int64ObserverResult) {
+		return func(_ context.Context, result metric.Int64ObserverResult) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			for _, q := range h.buffers {
+				result.Observe(value(q.stats()), attribute.String("signal", q.signal))
+			}
+		}
+	}
+
+	metric.Must(meter).
+		NewInt64CounterObserver(
+			"telemetry/buffer_dropped",
+			observeBuffers(func(dropped, _, _ int64) int64 { return dropped }),
+			metric.WithDescription("The number of spans or metrics dropped from the disk buffer to stay within its size"),
+		)
+	metric.Must(meter).
+		NewInt64CounterObserver(
+			"telemetry/buffer_replayed",
+			observeBuffers(func(_, replayed, _ int64) int64 { return replayed }),
+			metric.WithDescription("The number of spans or metrics sent from the disk buffer after the collector was unreachable"),
+		)
+	metric.Must(meter).
+		NewInt64GaugeObserver(
+			"telemetry/buffer_size",
+			observeBuffers(func(_, _, size int64) int64 { return size }),
+			metric.WithDescription("The size of the disk buffer"),
+			metric.WithUnit("By"),
+		)
+}
+
+// MonitoredTraceClient reports the outcome of every upload of spans.
+type MonitoredTraceClient struct {
+	otlptrace.Client
+}
+
+func (c MonitoredTraceClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	err := c.Client.UploadTraces(ctx, protoSpans)
+	TelemetryHealth.report("traces", err)
+	return err
+}
+
+// MonitoredMetricClient reports the outcome of every upload of metrics.
+type MonitoredMetricClient struct {
+	otlpmetric.Client
+}
+
+func (c MonitoredMetricClient) UploadMetrics(ctx context.Context, protoMetrics []*metricpb.ResourceMetrics) error {
+	err := c.Client.UploadMetrics(ctx, protoMetrics)
+	TelemetryHealth.report("metrics", err)
+	return err
+}
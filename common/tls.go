@@ -0,0 +1,112 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// TLS is optional and configured from certificate paths. TLS_CERT_FILE and
+// TLS_KEY_FILE hold the certificate of the service, which is then served over
+// HTTPS and presented as client certificate. TLS_CA_FILE is the CA the peers
+// are verified against, the calls to other services switch to HTTPS with it.
+// TLS_REQUIRE_CLIENT_CERT=true only accepts clients presenting a certificate
+// signed by that CA (mTLS), and OTLP_TLS=true exports to the collector over
+// TLS as well. The gencerts command creates a dev CA and the certificates.
+type TLSSettings struct {
+	// nil when the server is plain HTTP
+	Server *tls.Config
+	// nil when the calls to other services are plain HTTP
+	Client    *tls.Config
+	Transport http.RoundTripper
+	otlp      bool
+}
+
+var ServiceTLS = mustLoadTLS()
+
+func mustLoadTLS() TLSSettings {
+	s, err := loadTLS()
+	if err != nil {
+		log.Fatalf("Failed to load the TLS configuration: %v", err)
+	}
+	return s
+}
+
+func loadTLS() (TLSSettings, error) {
+	s := TLSSettings{Transport: http.DefaultTransport}
+
+	var certs []tls.Certificate
+	if certFile := getenv("TLS_CERT_FILE", ""); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, getenv("TLS_KEY_FILE", ""))
+		if err != nil {
+			return s, err
+		}
+		certs = append(certs, cert)
+	}
+
+	var pool *x509.CertPool
+	if caFile := getenv("TLS_CA_FILE", ""); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return s, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return s, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+
+	if len(certs) > 0 {
+		s.Server = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: certs,
+			ClientCAs:    pool,
+		}
+		if getenv("TLS_REQUIRE_CLIENT_CERT", "false") == "true" {
+			if pool == nil {
+				return s, fmt.Errorf("TLS_REQUIRE_CLIENT_CERT needs TLS_CA_FILE to verify the clients")
+			}
+			s.Server.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if pool != nil {
+		s.Client = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			RootCAs:      pool,
+			Certificates: certs,
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = s.Client
+		s.Transport = transport
+	}
+
+	s.otlp = getenv("OTLP_TLS", "false") == "true"
+	if s.otlp && s.Client == nil {
+		return s, fmt.Errorf("OTLP_TLS needs TLS_CA_FILE to verify the collector")
+	}
+
+	return s, nil
+}
+
+// scheme is the URL scheme of the calls to other services.
+func (s TLSSettings) Scheme() string {
+	if s.Client != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// collectorCredentials secure the gRPC connection to the collector.
+func (s TLSSettings) collectorCredentials() credentials.TransportCredentials {
+	if !s.otlp {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(s.Client)
+}
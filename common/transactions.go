@@ -0,0 +1,260 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+type TxState string
+
+const (
+	StateAuthorized        TxState = "authorized"
+	StateCaptured          TxState = "captured"
+	StateVoided            TxState = "voided"
+	StatePartiallyRefunded TxState = "partially-refunded"
+	StateRefunded          TxState = "refunded"
+)
+
+// transitions lists the states each state may move to. Anything else is
+// rejected, e.g. capturing a voided authorization or capturing twice.
+var transitions = map[TxState][]TxState{
+	StateAuthorized:        {StateCaptured, StateVoided},
+	StateCaptured:          {StatePartiallyRefunded, StateRefunded},
+	StatePartiallyRefunded: {StatePartiallyRefunded, StateRefunded},
+}
+
+// transactionRetention is how long a transaction is kept after its last
+// change, by state: an authorization as long as it holds the funds, a capture
+// as long as it may be refunded and a voided or refunded one for a day.
+// Transactions in a state which is not listed are kept.
+var transactionRetention = map[TxState]time.Duration{
+	StateAuthorized:        7 * 24 * time.Hour,
+	StateCaptured:          90 * 24 * time.Hour,
+	StatePartiallyRefunded: 90 * 24 * time.Hour,
+	StateVoided:            24 * time.Hour,
+	StateRefunded:          24 * time.Hour,
+}
+
+// transactionPrunePeriod is how often the store looks for transactions past
+// their retention.
+const transactionPrunePeriod = time.Minute
+
+var (
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrInvalidTransition   = errors.New("invalid transaction state transition")
+	ErrInvalidAmount       = errors.New("invalid amount")
+	ErrInvalidCurrency     = errors.New("invalid currency")
+	ErrRefundExceeded      = errors.New("refund exceeds the captured amount")
+)
+
+// currencyPattern matches ISO 4217 currency codes.
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Transaction is one payment. Amounts are in minor units of Currency, e.g.
+// cents of USD, the refunds are in the currency of the transaction.
+type Transaction struct {
+	ID        string    `json:"transaction-id"`
+	State     TxState   `json:"state"`
+	Name      string    `json:"name"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	Source    string    `json:"source,omitempty"`
+	Refunds   []Refund  `json:"refunds,omitempty"`
+	CreatedAt time.Time `json:"created-at"`
+	UpdatedAt time.Time `json:"updated-at"`
+}
+
+type Refund struct {
+	ID        string    `json:"refund-id"`
+	Amount    int64     `json:"amount"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created-at"`
+}
+
+// Refunded is the total amount already given back to the customer.
+func (tx Transaction) Refunded() int64 {
+	var total int64
+	for _, r := range tx.Refunds {
+		total += r.Amount
+	}
+	return total
+}
+
+// TransactionStore keeps the transactions in memory and writes them through
+// to a JSON file, so transaction IDs survive a restart of the service. The
+// transactions past their retention are dropped along with new ones.
+type TransactionStore struct {
+	mu     sync.Mutex
+	path   string
+	prefix string
+	txs    map[string]*Transaction
+	pruned time.Time
+}
+
+func NewTransactionStore(path, prefix string) (*TransactionStore, error) {
+	s := &TransactionStore{path: path, prefix: prefix, txs: make(map[string]*Transaction)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.txs); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Authorize creates a new transaction in the authorized state. source is a
+// displayable, non-sensitive description of the funding source.
+func (s *TransactionStore) Authorize(name string, amount int64, currency, source string) (Transaction, error) {
+	if amount <= 0 {
+		return Transaction{}, fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+	if !currencyPattern.MatchString(currency) {
+		return Transaction{}, fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := s.newID()
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(s.pruned) > transactionPrunePeriod {
+		s.prune(now)
+	}
+	tx := &Transaction{ID: id, State: StateAuthorized, Name: name, Amount: amount, Currency: currency, Source: source, CreatedAt: now, UpdatedAt: now}
+	s.txs[id] = tx
+
+	return *tx, s.save()
+}
+
+// Transition moves the transaction id to state to if the state machine
+// allows it.
+func (s *TransactionStore) Transition(id string, to TxState) (Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.txs[id]
+	if !ok {
+		return Transaction{}, ErrTransactionNotFound
+	}
+	if !allowed(tx.State, to) {
+		return *tx, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, tx.State, to)
+	}
+
+	tx.State = to
+	tx.UpdatedAt = time.Now().UTC()
+
+	return *tx, s.save()
+}
+
+// Refund gives back amount of a captured transaction, or everything that is
+// left when amount is 0. Refunds never exceed the captured amount in total and
+// are in the currency of the transaction, currency may be left empty.
+func (s *TransactionStore) Refund(id string, amount int64, currency, reason string) (Transaction, Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.txs[id]
+	if !ok {
+		return Transaction{}, Refund{}, ErrTransactionNotFound
+	}
+	// the transactions stored before they had a currency take any
+	if currency != "" && tx.Currency != "" && currency != tx.Currency {
+		return *tx, Refund{}, fmt.Errorf("%w: %s, the transaction is in %s", ErrInvalidCurrency, currency, tx.Currency)
+	}
+
+	remaining := tx.Amount - tx.Refunded()
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount < 0 {
+		return *tx, Refund{}, fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+	if amount > remaining {
+		return *tx, Refund{}, fmt.Errorf("%w: %d requested, %d remaining", ErrRefundExceeded, amount, remaining)
+	}
+
+	to := StatePartiallyRefunded
+	if amount == remaining {
+		to = StateRefunded
+	}
+	if !allowed(tx.State, to) {
+		return *tx, Refund{}, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, tx.State, to)
+	}
+
+	refundID, err := s.newID()
+	if err != nil {
+		return *tx, Refund{}, err
+	}
+
+	now := time.Now().UTC()
+	r := Refund{ID: refundID, Amount: amount, Reason: reason, CreatedAt: now}
+	tx.Refunds = append(tx.Refunds, r)
+	tx.State = to
+	tx.UpdatedAt = now
+
+	return *tx, r, s.save()
+}
+
+// prune drops the transactions past their retention at now, the caller saves
+// the store.
+func (s *TransactionStore) prune(now time.Time) {
+	s.pruned = now
+	for id, tx := range s.txs {
+		if retention, ok := transactionRetention[tx.State]; ok && now.Sub(tx.UpdatedAt) > retention {
+			delete(s.txs, id)
+		}
+	}
+}
+
+func allowed(from, to TxState) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TransactionStore) newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return s.prefix + "-" + hex.EncodeToString(b), nil
+}
+
+// save writes the whole store to a temporary file and renames it over the
+// previous one, so a crash never leaves a truncated file behind.
+func (s *TransactionStore) save() error {
+	data, err := json.MarshalIndent(s.txs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
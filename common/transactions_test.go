@@ -0,0 +1,220 @@
+package common
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAuthorizationIsCapturedOrVoidedOnce moves one authorization to captured
+// and another to voided. Neither may move on afterwards, so a payment is never
+// captured twice or captured after it was voided.
+func TestAuthorizationIsCapturedOrVoidedOnce(t *testing.T) {
+	store, err := NewTransactionStore(filepath.Join(t.TempDir(), "transactions.json"), "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, to := range []TxState{StateCaptured, StateVoided} {
+		tx, err := store.Authorize("Arman", 1200, "USD", "visa ****1111")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.State != StateAuthorized {
+			t.Fatalf("authorize returned a transaction in %s, want %s", tx.State, StateAuthorized)
+		}
+
+		tx, err = store.Transition(tx.ID, to)
+		if err != nil || tx.State != to {
+			t.Fatalf("%s returned %s, %v, want %s", to, tx.State, err, to)
+		}
+		for _, next := range []TxState{StateAuthorized, StateCaptured, StateVoided} {
+			again, err := store.Transition(tx.ID, next)
+			if !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("%s after %s returned %v, want %v", next, to, err, ErrInvalidTransition)
+			}
+			if again.State != to {
+				t.Errorf("%s after %s left the transaction in %s", next, to, again.State)
+			}
+		}
+	}
+
+	if _, err := store.Transition("CREDIT-0123456789abcdef", StateCaptured); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("capturing an unknown transaction returned %v, want %v", err, ErrTransactionNotFound)
+	}
+}
+
+// TestTransactionsSurviveRestart authorizes a payment and opens the store
+// again, as a restarted provider would. The authorization must still be there
+// to be captured.
+func TestTransactionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.json")
+	store, err := NewTransactionStore(path, "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := store.Authorize("Arman", 1200, "USD", "visa ****1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewTransactionStore(path, "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured, err := store.Transition(tx.ID, StateCaptured)
+	if err != nil {
+		t.Fatalf("capture after a restart returned %v", err)
+	}
+	if captured.Amount != 1200 || captured.Name != "Arman" {
+		t.Errorf("the restarted store returned %+v, want the authorization of 1200 for Arman", captured)
+	}
+}
+
+// TestRefundsNeverExceedTheCapture refunds a captured payment in parts. Every
+// refund is taken off what is left, one beyond it is rejected without a
+// change, and the last one moves the transaction to refunded.
+func TestRefundsNeverExceedTheCapture(t *testing.T) {
+	store, err := NewTransactionStore(filepath.Join(t.TempDir(), "transactions.json"), "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := store.Authorize("Arman", 1200, "USD", "visa ****1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.Refund(tx.ID, 100, "USD", "damaged"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("refunding an authorization returned %v, want %v", err, ErrInvalidTransition)
+	}
+	if _, err := store.Transition(tx.ID, StateCaptured); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, r, err := store.Refund(tx.ID, 200, "USD", "damaged")
+	if err != nil || r.Amount != 200 || tx.State != StatePartiallyRefunded || tx.Refunded() != 200 {
+		t.Fatalf("refunding 200 of 1200 returned %s with %d refunded, %v", tx.State, tx.Refunded(), err)
+	}
+	if _, _, err := store.Refund(tx.ID, -1, "USD", "damaged"); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("refunding -1 returned %v, want %v", err, ErrInvalidAmount)
+	}
+	tx, _, err = store.Refund(tx.ID, 1001, "USD", "damaged")
+	if !errors.Is(err, ErrRefundExceeded) {
+		t.Errorf("refunding 1001 of the 1000 left returned %v, want %v", err, ErrRefundExceeded)
+	}
+	if tx.State != StatePartiallyRefunded || tx.Refunded() != 200 {
+		t.Errorf("the rejected refund left %s with %d refunded, want %s with 200", tx.State, tx.Refunded(), StatePartiallyRefunded)
+	}
+
+	tx, r, err = store.Refund(tx.ID, 1000, "USD", "damaged")
+	if err != nil || r.Amount != 1000 || tx.State != StateRefunded || tx.Refunded() != 1200 {
+		t.Fatalf("refunding the 1000 left returned %s with %d refunded, %v", tx.State, tx.Refunded(), err)
+	}
+	if _, _, err := store.Refund(tx.ID, 0, "USD", "damaged"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("refunding a refunded transaction returned %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+// TestRefundWithoutAmountRefundsTheRest refunds a part of a captured payment
+// and then the rest, without naming its amount.
+func TestRefundWithoutAmountRefundsTheRest(t *testing.T) {
+	store, err := NewTransactionStore(filepath.Join(t.TempDir(), "transactions.json"), "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := store.Authorize("Arman", 1200, "USD", "visa ****1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transition(tx.ID, StateCaptured); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Refund(tx.ID, 500, "USD", "damaged"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, r, err := store.Refund(tx.ID, 0, "", "requested-by-customer")
+	if err != nil || r.Amount != 700 || tx.State != StateRefunded {
+		t.Errorf("refunding the rest returned %d and %s, %v, want 700 and %s", r.Amount, tx.State, err, StateRefunded)
+	}
+}
+
+// TestAmountsKeepTheirCurrency authorizes payments without a valid amount or
+// currency, and refunds a payment in another currency than it was made in.
+// All of them must be rejected.
+func TestAmountsKeepTheirCurrency(t *testing.T) {
+	store, err := NewTransactionStore(filepath.Join(t.TempDir(), "transactions.json"), "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Authorize("Arman", 0, "USD", ""); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("authorizing 0 returned %v, want %v", err, ErrInvalidAmount)
+	}
+	if _, err := store.Authorize("Arman", 1200, "usd", ""); !errors.Is(err, ErrInvalidCurrency) {
+		t.Errorf("authorizing in usd returned %v, want %v", err, ErrInvalidCurrency)
+	}
+
+	tx, err := store.Authorize("Arman", 1200, "JPY", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transition(tx.ID, StateCaptured); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Refund(tx.ID, 100, "USD", "damaged"); !errors.Is(err, ErrInvalidCurrency) {
+		t.Errorf("refunding USD of a JPY payment returned %v, want %v", err, ErrInvalidCurrency)
+	}
+	if tx, r, err := store.Refund(tx.ID, 100, "JPY", "damaged"); err != nil || r.Amount != 100 || tx.Currency != "JPY" {
+		t.Errorf("refunding 100 JPY returned %+v, %v", r, err)
+	}
+}
+
+// TestFinishedTransactionsArePruned voids one authorization and captures
+// another. A day later a new authorization drops the voided one, also from
+// the file the store is opened again with, while the capture stays
+// refundable.
+func TestFinishedTransactionsArePruned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.json")
+	store, err := NewTransactionStore(path, "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	voided, err := store.Authorize("Arman", 1200, "USD", "visa ****1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transition(voided.ID, StateVoided); err != nil {
+		t.Fatal(err)
+	}
+	captured, err := store.Authorize("Arman", 1200, "USD", "visa ****1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transition(captured.ID, StateCaptured); err != nil {
+		t.Fatal(err)
+	}
+
+	store.prune(time.Now().Add(23 * time.Hour))
+	if _, err := store.Transition(voided.ID, StateCaptured); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("capturing the voided transaction within a day returned %v, want %v", err, ErrInvalidTransition)
+	}
+
+	// the next authorization prunes once the last prune is a while ago
+	store.pruned = time.Now().Add(-25 * time.Hour)
+	store.txs[voided.ID].UpdatedAt = store.txs[voided.ID].UpdatedAt.Add(-25 * time.Hour)
+	if _, err := store.Authorize("Arman", 1200, "USD", "visa ****1111"); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewTransactionStore(path, "CREDIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transition(voided.ID, StateCaptured); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("capturing the voided transaction a day later returned %v, want %v", err, ErrTransactionNotFound)
+	}
+	if _, _, err := store.Refund(captured.ID, 0, "USD", "damaged"); err != nil {
+		t.Errorf("refunding the capture after the prune returned %v", err)
+	}
+}
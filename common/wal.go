@@ -0,0 +1,258 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walBaseBackoff = time.Second
+	walMaxBackoff  = 30 * time.Second
+	walSendTimeout = 30 * time.Second
+)
+
+// diskQueue is a write-ahead queue of export requests on local disk. Every
+// batch is written to its own file before it is sent and only removed once
+// the collector accepted it, so the batches survive collector outages as well
+// as restarts of the service. When the queue grows over maxSize bytes the
+// oldest batches are dropped first.
+type diskQueue struct {
+	signal  string
+	dir     string
+	maxSize int64
+	send    func(ctx context.Context, data []byte) error
+
+	mu       sync.Mutex
+	seq      uint64
+	files    []queuedBatch // oldest first
+	size     int64
+	dropped  int64
+	replayed int64
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type queuedBatch struct {
+	name  string
+	size  int64
+	items int64
+	// set once sending the batch failed, or when it was left over by a
+	// previous run, so it counts as replayed when it finally gets through
+	replay bool
+}
+
+// newDiskQueue opens the queue in dir, picking up the batches left over by a
+// previous run, and starts sending them in the background.
+func newDiskQueue(signal, dir string, maxSize int64, send func(ctx context.Context, data []byte) error) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		signal:  signal,
+		dir:     dir,
+		maxSize: maxSize,
+		send:    send,
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// ReadDir sorts by name, and the names start with the zero padded
+	// sequence number, so the batches come back oldest first
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			// the write of this batch never completed
+			_ = os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		var seq uint64
+		var items int64
+		if _, err := fmt.Sscanf(info.Name(), "%d-%d.pb", &seq, &items); err != nil {
+			continue
+		}
+		q.files = append(q.files, queuedBatch{name: info.Name(), size: info.Size(), items: items, replay: true})
+		q.size += info.Size()
+		if seq > q.seq {
+			q.seq = seq
+		}
+	}
+	if len(q.files) > 0 {
+		Logger.Printf("Replaying %d %s batches (%d bytes) buffered by a previous run\n", len(q.files), signal, q.size)
+	}
+	q.evict()
+
+	go q.run()
+	return q, nil
+}
+
+// push writes the batch holding items spans, metrics, ... to disk.
+func (q *diskQueue) push(data []byte, items int64) error {
+	q.mu.Lock()
+	q.seq++
+	name := fmt.Sprintf("%020d-%d.pb", q.seq, items)
+	q.mu.Unlock()
+
+	path := filepath.Join(q.dir, name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.files = append(q.files, queuedBatch{name: name, size: int64(len(data)), items: items})
+	q.size += int64(len(data))
+	q.evict()
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// evict drops the oldest batches until the queue fits in maxSize again. The
+// caller must hold q.mu.
+func (q *diskQueue) evict() {
+	for q.size > q.maxSize && len(q.files) > 0 {
+		oldest := q.files[0]
+		q.files = q.files[1:]
+		q.size -= oldest.size
+		q.dropped += oldest.items
+		_ = os.Remove(filepath.Join(q.dir, oldest.name))
+		Logf(context.Background(), LevelWarn, "Telemetry buffer is full, dropped the oldest %s batch of %d items\n", q.signal, oldest.items)
+	}
+}
+
+func (q *diskQueue) run() {
+	defer close(q.done)
+
+	backoff := walBaseBackoff
+	for {
+		batch, ok := q.oldest()
+		if !ok {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), walSendTimeout)
+		err := q.sendBatch(ctx, batch)
+		cancel()
+		if err == nil {
+			backoff = walBaseBackoff
+			continue
+		}
+
+		// exponential backoff with full jitter before trying the collector again
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))))
+		select {
+		case <-timer.C:
+		case <-q.stop:
+			timer.Stop()
+			return
+		}
+		if backoff *= 2; backoff > walMaxBackoff {
+			backoff = walMaxBackoff
+		}
+	}
+}
+
+func (q *diskQueue) oldest() (queuedBatch, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.files) == 0 {
+		return queuedBatch{}, false
+	}
+	return q.files[0], true
+}
+
+// sendBatch sends one batch and removes it from the queue once it was
+// accepted. The batch may have been evicted in the meantime, in which case
+// there is nothing left to send.
+func (q *diskQueue) sendBatch(ctx context.Context, batch queuedBatch) error {
+	path := filepath.Join(q.dir, batch.name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = q.send(ctx, data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, f := range q.files {
+		if f.name != batch.name {
+			continue
+		}
+		if err != nil {
+			q.files[i].replay = true
+			return err
+		}
+		q.files = append(q.files[:i], q.files[i+1:]...)
+		q.size -= f.size
+		if f.replay {
+			q.replayed += f.items
+		}
+		_ = os.Remove(path)
+		break
+	}
+	return err
+}
+
+// close stops sending in the background and then tries to send what is left
+// until ctx is done. Whatever could not be sent stays on disk for the next run.
+func (q *diskQueue) close(ctx context.Context) error {
+	close(q.stop)
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for {
+		batch, ok := q.oldest()
+		if !ok {
+			return nil
+		}
+		if err := q.sendBatch(ctx, batch); err != nil {
+			q.mu.Lock()
+			Logger.Printf("Left %d %s batches (%d bytes) buffered on disk\n", len(q.files), q.signal, q.size)
+			q.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// stats returns the number of items dropped by eviction and replayed after a
+// failure so far, and the current size of the queue in bytes.
+func (q *diskQueue) stats() (dropped, replayed, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped, q.replayed, q.size
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	webhookPollPeriod  = 5 * time.Second
+	webhookMaxAttempts = 5
+	webhookBaseBackoff = 500 * time.Millisecond
+	// the back-end stores an order only once its payment is captured, after
+	// the shipment was created, so an unknown one may just not be there yet
+	webhookUnknownWindow = time.Minute
+)
+
+var (
+	// errWebhookRejected is returned for client errors, which are not retried
+	// since sending the same callback again would not change the answer.
+	errWebhookRejected = errors.New("webhook rejected")
+	// errWebhookUnknown is the rejection of a shipment whose order the
+	// back-end does not know.
+	errWebhookUnknown = fmt.Errorf("%w: order unknown", errWebhookRejected)
+)
+
+// WebhookNotifier pushes the status changes of the shipments to the back-end
+// at WEBHOOK_URL, signed with WEBHOOK_SECRET. A status is only marked as
+// notified once the back-end accepted it, so undelivered callbacks are retried
+// on the next poll as well.
+type WebhookNotifier struct {
+	carrier   string
+	url       string
+	secret    []byte
+	shipments *ShipmentStore
+	clock     ShipmentClock
+	client    *http.Client
+	tracer    trace.Tracer
+}
+
+func NewWebhookNotifier(carrier string, shipments *ShipmentStore, clock ShipmentClock) *WebhookNotifier {
+	return &WebhookNotifier{
+		carrier:   carrier,
+		url:       getenv("WEBHOOK_URL", "http://back-end/webhooks/shipping"),
+		secret:    []byte(getenv("WEBHOOK_SECRET", "handson-webhook-secret")),
+		shipments: shipments,
+		clock:     clock,
+		client:    &http.Client{Timeout: 5 * time.Second, Transport: ServiceTLS.Transport},
+		tracer:    otel.Tracer("handson-opentelemetry/" + strings.ToLower(carrier)),
+	}
+}
+
+// Run polls the pending shipments for status changes, and prunes the store,
+// until the process ends.
+func (n *WebhookNotifier) Run() {
+	ticker := time.NewTicker(webhookPollPeriod)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		n.poll(now)
+	}
+}
+
+func (n *WebhookNotifier) poll(now time.Time) {
+	for _, sh := range n.shipments.Pending() {
+		for _, e := range sh.Unnotified(n.clock) {
+			err := n.notify(sh, e)
+			if errors.Is(err, errWebhookUnknown) && now.Sub(e.Time) < webhookUnknownWindow {
+				break
+			}
+			if err != nil && !errors.Is(err, errWebhookRejected) {
+				Logf(context.Background(), LevelError, "Failed to notify %s of shipment %s: %v\n", e.Status, sh.TrackingNumber, err)
+				break
+			}
+			if err := n.shipments.MarkNotified(sh.TrackingNumber, e.Status, now); err != nil {
+				Logf(context.Background(), LevelError, "Failed to save notified status of shipment %s: %v\n", sh.TrackingNumber, err)
+				break
+			}
+		}
+	}
+	if err := n.shipments.Prune(now); err != nil {
+		Logf(context.Background(), LevelError, "Failed to prune the shipments: %v\n", err)
+	}
+}
+
+// notify sends one status change in a new trace, linked to the span which
+// created the shipment during the checkout.
+func (n *WebhookNotifier) notify(sh Shipment, e ShipmentEvent) error {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("tracking-number", sh.TrackingNumber),
+			attribute.String("shipment-status", e.Status),
+		),
+	}
+	if origin := sh.Origin(); origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	ctx, span := n.tracer.Start(context.Background(), "shipment-status-webhook", opts...)
+	defer span.End()
+
+	payload, err := json.Marshal(struct {
+		Carrier        string `json:"carrier"`
+		TrackingNumber string `json:"tracking-number"`
+		Status         string `json:"status"`
+		Time           string `json:"time"`
+	}{n.carrier, sh.TrackingNumber, e.Status, e.Time.Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if err = n.send(ctx, payload); err == nil {
+			span.AddEvent("Webhook delivered", trace.WithAttributes(attribute.Int("attempt", attempt)))
+			return nil
+		}
+		span.AddEvent("Webhook attempt failed", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.Key("err").String(err.Error()),
+		))
+		if errors.Is(err, errWebhookRejected) {
+			break
+		}
+
+		if attempt < webhookMaxAttempts {
+			// exponential backoff with full jitter
+			backoff := webhookBaseBackoff << (attempt - 1)
+			<-time.After(time.Duration(rand.Int63n(int64(backoff))))
+		}
+	}
+
+	span.SetStatus(codes.Error, "webhook not delivered")
+	return err
+}
+
+func (n *WebhookNotifier) send(ctx context.Context, payload []byte) error {
+	req, _ := http.NewRequest("POST", n.url, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	// the signature covers the timestamp as well so a captured callback can not be replayed later
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil
+	case res.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: back-end answered with status %d", errWebhookUnknown, res.StatusCode)
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: back-end answered with status %d", errWebhookRejected, res.StatusCode)
+	default:
+		return fmt.Errorf("back-end answered with status %d", res.StatusCode)
+	}
+}
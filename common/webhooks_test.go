@@ -0,0 +1,61 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestWebhookWaitsForTheOrder notifies the back-end of a new shipment before
+// the checkout stored its order, which the back-end answers with 404. The
+// status must be sent again on the next polls until the order is there, and
+// only given up once it did not turn up for a while.
+func TestWebhookWaitsForTheOrder(t *testing.T) {
+	stored := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !stored {
+			http.Error(w, "order not found", http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	store, err := NewShipmentStore(filepath.Join(t.TempDir(), "shipments.json"), sequentialTrackingNumbers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now()
+	now := created
+	n := NewWebhookNotifier("TOLL", store, ShipmentClock{now: func() time.Time { return now }, speed: 1})
+	n.url, n.client = backend.URL, backend.Client()
+
+	waiting, err := store.Create("24 Ferdowsi St", []string{"iPad Air"}, trace.SpanContext{}, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.poll(now)
+	if sh, _ := store.Get(waiting.TrackingNumber); sh.Notified != "" {
+		t.Fatalf("a shipment of an unknown order was marked notified of %s", sh.Notified)
+	}
+	stored = true
+	now = created.Add(10 * time.Second)
+	n.poll(now)
+	if sh, _ := store.Get(waiting.TrackingNumber); sh.Notified != "label-created" {
+		t.Errorf("the shipment was notified of %q once the order was stored, want label-created", sh.Notified)
+	}
+
+	// an order which never turns up, e.g. since its payment was not captured
+	stored = false
+	lost, err := store.Create("24 Ferdowsi St", []string{"Pixel 6"}, trace.SpanContext{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * webhookUnknownWindow)
+	n.poll(now)
+	if sh, _ := store.Get(lost.TrackingNumber); sh.Notified != "label-created" {
+		t.Errorf("the shipment of an unknown order was notified of %q after the window, want it given up", sh.Notified)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// card is the payment card of an authorize request. The number is only ever
+// used for validation; what gets logged, traced or stored is the brand and
+// the last four digits.
+type card struct {
+	Number string `json:"number"`
+	Expiry string `json:"expiry"` // MM/YY
+	CVV    string `json:"cvv"`
+}
+
+// String keeps the PAN and CVV out of logs, e.g. when the request is printed
+// with %+v.
+func (c card) String() string {
+	return fmt.Sprintf("{brand:%s last4:%s expiry:%s}", cardBrand(c.digits()), c.last4(), c.Expiry)
+}
+
+func (c card) digits() string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(c.Number)
+}
+
+func (c card) last4() string {
+	d := c.digits()
+	if len(d) < 4 {
+		return ""
+	}
+	return d[len(d)-4:]
+}
+
+// decline is the structured reason of a rejected card, the code is what the
+// payment-gateway maps to a user-facing error.
+type decline struct {
+	Code    string `json:"decline-code"`
+	Message string `json:"message"`
+}
+
+func (d *decline) Error() string {
+	return d.Code + ": " + d.Message
+}
+
+const (
+	declineInvalidNumber    = "invalid_number"
+	declineUnsupportedBrand = "unsupported_brand"
+	declineInvalidExpiry    = "invalid_expiry"
+	declineExpiredCard      = "expired_card"
+	declineInvalidCVV       = "invalid_cvv"
+)
+
+// validate checks the card number (Luhn and brand), the expiry date against
+// now and the CVV length for the brand. It returns the detected brand.
+func (c card) validate(now time.Time) (string, *decline) {
+	number := c.digits()
+	if len(number) < 12 || len(number) > 19 || !isDigits(number) || !luhnValid(number) {
+		return "", &decline{declineInvalidNumber, "card number is invalid"}
+	}
+
+	brand := cardBrand(number)
+	if brand == "unknown" {
+		return brand, &decline{declineUnsupportedBrand, "card brand is not supported"}
+	}
+
+	expiry, err := time.Parse("01/06", c.Expiry)
+	if err != nil {
+		return brand, &decline{declineInvalidExpiry, "expiry must be MM/YY"}
+	}
+	// a card is valid until the end of its expiry month
+	if !now.Before(expiry.AddDate(0, 1, 0)) {
+		return brand, &decline{declineExpiredCard, "card has expired"}
+	}
+
+	cvvLen := 3
+	if brand == "amex" {
+		cvvLen = 4
+	}
+	if len(c.CVV) != cvvLen || !isDigits(c.CVV) {
+		return brand, &decline{declineInvalidCVV, fmt.Sprintf("cvv must be %d digits", cvvLen)}
+	}
+
+	return brand, nil
+}
+
+// luhnValid reports whether number passes the Luhn checksum.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// cardBrand detects the brand from the issuer identification number.
+func cardBrand(number string) string {
+	prefix := func(n int) int {
+		if len(number) < n {
+			return -1
+		}
+		v, err := strconv.Atoi(number[:n])
+		if err != nil {
+			return -1
+		}
+		return v
+	}
+
+	switch {
+	case prefix(1) == 4:
+		return "visa"
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720:
+		return "mastercard"
+	case prefix(2) == 34, prefix(2) == 37:
+		return "amex"
+	case prefix(4) == 6011, prefix(2) == 65, prefix(3) >= 644 && prefix(3) <= 649:
+		return "discover"
+	default:
+		return "unknown"
+	}
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -9,16 +9,24 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	// "go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"github.com/arman-madi/handson-opentelemetry/common"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/jaeger"
-	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
-	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/global"
 	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
@@ -30,84 +38,152 @@ type Dhl struct {
 	Basket  []string `json:"basket"`
 }
 
-var logger = log.New(os.Stderr, "[dhl] ", log.Ldate|log.Ltime|log.Llongfile)
+var logger = common.NewLogger("dhl")
 
 // Create one tracer per package
 // NOTE: You only need a tracer if you are creating your own spans
 var tracer trace.Tracer
 
-// initTracer creates a new trace provider instance and registers it as global trace provider.
-func initTracer() /*(*sdktrace.TracerProvider, error)*/ func() {
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
+func initProvider() func() {
+	ctx := context.Background()
 
-	// ** STDOUT Exporter
-	stdoutExporter, err := stdouttrace.New( /*stdouttrace.WithPrettyPrint()*/ )
-	if err != nil {
-		log.Fatal("failed to initialize stdouttrace exporter: ", err)
-	}
+	otelAgentAddr := "otel-collector:4317"
 
-	// ** Jaeger Exporter
-	jaegerUrl := "http://jaeger:14268/api/traces"
-	jaegerExporter, err := jaeger.New(
-		jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(jaegerUrl)),
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithProcess(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithAttributes(
+			// the service name used to display traces in backends
+			semconv.ServiceNameKey.String("dhl"),
+			attribute.String("environment", "demo"),
+			attribute.Int64("ID", 4),
+		),
 	)
-	if err != nil {
-		log.Fatal("failed to initialize jaeger exporter: ", err)
-	}
+	handleErr(err, "failed to create resource")
 
-	// ** Zipkin Exporter
-	zipkinUrl := "http://zipkin:9411/api/v2/spans"
-	zipkinExporter, err := zipkin.New(
-		zipkinUrl,
-		// zipkin.WithLogger(logger),
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
 	)
-	if err != nil {
-		log.Fatal(err)
-	}
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
 
-	// ** Trace Provider
-	// For demoing purposes, always sample. In a production application, you should
-	// configure the sampler to a trace.ParentBased(trace.TraceIDRatioBased) set at the desired
-	// ratio.
-	tp := sdktrace.NewTracerProvider(
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
+	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
+	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithBatcher(zipkinExporter, sdktrace.WithMaxExportBatchSize(1)),
-		sdktrace.WithBatcher(jaegerExporter, sdktrace.WithMaxExportBatchSize(1)),
-		sdktrace.WithBatcher(stdoutExporter, sdktrace.WithMaxExportBatchSize(1)),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String("dhl"),
-			attribute.String("environment", "demo"),
-			attribute.Int64("ID", 4),
-		)),
+		sdktrace.WithResource(res),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
 	)
 
-	// Register our TracerProvider as the global so any imported
-	// instrumentation in the future will default to using it.
-	otel.SetTracerProvider(tp)
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetTracerProvider(tracerProvider)
 
-	// Name the tracer after the package, or the service if you are in main
-	tracer = otel.Tracer("handson-opentelemetry/dhl")
-
-	// Register the TraceContext propagator globally.
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
 
 	return func() {
-		_ = tp.Shutdown(context.Background())
+		// bounded like the drain, so a collector which is down does not keep
+		// the container from stopping
+		cxt, cancel := context.WithTimeout(ctx, common.ShutdownTimeout())
+		defer cancel()
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+	}
+}
+
+func handleErr(err error, message string) {
+	if err != nil {
+		log.Fatalf("%s: %v", message, err)
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
 }
 
 func main() {
 	logger.Println("Hello, this is dhl service which is responsible to ship goods via DHL in order to demonestrate how OpenTelemetry works!")
 
-	shutdown := initTracer()
+	shutdown := initProvider()
 	defer shutdown()
 
+	tracer = otel.Tracer("handson-opentelemetry/dhl")
+
+	shipments, err := common.NewShipmentStore(getenv("SHIPMENTS_FILE", "shipments.json"), newTrackingNumber)
+	handleErr(err, "Failed to load the shipments")
+	clock := common.NewShipmentClock()
+	go common.NewWebhookNotifier("DHL", shipments, clock).Run()
+
 	dhlHandler := func(w http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
 		span := trace.SpanFromContext(ctx)
 		traceId := span.SpanContext().TraceID().String()
-		logger.Printf("Handle request with trace id: %+v\n", traceId)
+		common.Logf(ctx, common.LevelInfo, "Handle request with trace id: %+v\n", traceId)
 
 		var dhl Dhl
 		err := json.NewDecoder(req.Body).Decode(&dhl)
@@ -116,29 +192,84 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		logger.Printf("New request received: %+v\n", dhl)
+		common.Logf(ctx, common.LevelInfo, "New request received: %+v\n", dhl)
+
+		sh, err := ship(ctx, shipments, dhl)
+		if err != nil {
+			span.AddEvent("Error creating shipment", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			if !common.WriteDeadlineExceeded(w, ctx, err) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"tracking-number\": \"%v\"}\n", traceId, sh.TrackingNumber))
+	}
+
+	shipmentHandler := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		span := trace.SpanFromContext(req.Context())
+		tracking := strings.TrimPrefix(req.URL.Path, "/shipments/")
+		span.SetAttributes(attribute.String("tracking-number", tracking))
 
-		ship(ctx, dhl)
+		sh, err := shipments.Get(tracking)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 
-		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\"}\n", traceId))
+		status := sh.Status("DHL", clock)
+		span.SetAttributes(attribute.String("shipment-status", status.Status))
+		_ = json.NewEncoder(w).Encode(status)
 	}
 
-	otelHandler := otelhttp.NewHandler(http.HandlerFunc(dhlHandler), "handle-dhl")
+	otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(common.NewIdempotencyStore(), http.HandlerFunc(dhlHandler))), "handle-dhl")
 
 	http.Handle("/", otelHandler)
+	http.Handle("/shipments/", otelhttp.NewHandler(http.HandlerFunc(shipmentHandler), "handle-dhl-shipment"))
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"))
 	logger.Printf("Listening on port 80\n")
-	http.ListenAndServe(":80", nil)
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
 }
 
-func ship(ctx context.Context, dhl Dhl) {
+func ship(ctx context.Context, shipments *common.ShipmentStore, dhl Dhl) (common.Shipment, error) {
 	ctx, span := tracer.Start(ctx, "dhl-ship")
 	defer span.End()
 
 	span.AddEvent("Start shipping with DHL")
 
-	<-time.After(time.Second * time.Duration(rand.Intn(3)))
+	if err := common.Sleep(ctx, time.Second*time.Duration(rand.Intn(3))); err != nil {
+		return common.Shipment{}, err
+	}
 
-	span.SetAttributes(attribute.StringSlice("Products", dhl.Basket))
+	sh, err := shipments.Create(dhl.Address, dhl.Basket, span.SpanContext(), time.Now())
+	if err != nil {
+		return sh, err
+	}
+
+	span.SetAttributes(
+		attribute.StringSlice("Products", dhl.Basket),
+		attribute.String("tracking-number", sh.TrackingNumber),
+	)
 	span.AddEvent("Successfully shipped with DHL")
 
+	return sh, nil
+}
+
+// newTrackingNumber returns a 10 digit DHL Express waybill number, the last
+// digit is the first nine modulo 7.
+func newTrackingNumber() (string, error) {
+	serial, err := common.RandomDigits(9)
+	if err != nil {
+		return "", err
+	}
+	n, _ := strconv.Atoi(serial)
+	return fmt.Sprintf("%s%d", serial, n%7), nil
 }
@@ -0,0 +1,270 @@
+// Command fakesmtp is a local stand-in for a mail server. It accepts every
+// message sent to it over SMTP, stores it as an .eml file and lists the
+// stored messages over HTTP, so the emails of the notification service can be
+// looked at without sending anything for real.
+//
+//	go run ./fakesmtp -smtp :2525 -http :8025 -dir mail
+//
+// With -failure-rate a share of the messages is answered with a temporary
+// failure, which makes the senders retry.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxMessageSize bounds the DATA of one message.
+const maxMessageSize = 1 << 20
+
+var (
+	dir         string
+	failureRate float64
+	received    uint64
+)
+
+func main() {
+	smtpAddr := flag.String("smtp", ":25", "address the SMTP server listens on")
+	httpAddr := flag.String("http", ":80", "address the message listing listens on")
+	flag.StringVar(&dir, "dir", "mail", "directory the messages are stored in")
+	flag.Float64Var(&failureRate, "failure-rate", 0, "share of the messages answered with a temporary failure")
+	flag.Parse()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", dir, err)
+	}
+
+	l, err := net.Listen("tcp", *smtpAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *smtpAddr, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("Failed to accept a connection: %v", err)
+				continue
+			}
+			go serveSMTP(conn)
+		}
+	}()
+
+	http.HandleFunc("/messages", listMessages)
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintln(w, `{"status":"ok"}`)
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintln(w, `{"status":"ready"}`)
+	})
+
+	log.Printf("Accepting mail on %s, listing it on %s/messages", *smtpAddr, *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+}
+
+// session is the state of one SMTP conversation.
+type session struct {
+	from string
+	to   []string
+}
+
+func serveSMTP(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		_ = w.Flush()
+	}
+
+	reply("220 fakesmtp ready")
+	var s session
+	for {
+		_ = conn.SetDeadline(time.Now().Add(time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply("250 fakesmtp")
+		case "EHLO":
+			reply("250-fakesmtp")
+			reply("250-SIZE %d", maxMessageSize)
+			reply("250 8BITMIME")
+		case "MAIL":
+			s = session{from: address(arg, "FROM:")}
+			reply("250 OK")
+		case "RCPT":
+			if s.from == "" {
+				reply("503 MAIL first")
+				continue
+			}
+			s.to = append(s.to, address(arg, "TO:"))
+			reply("250 OK")
+		case "DATA":
+			if len(s.to) == 0 {
+				reply("503 RCPT first")
+				continue
+			}
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data, err := readData(r)
+			if err != nil {
+				reply("552 %v", err)
+				s = session{}
+				continue
+			}
+			if rand.Float64() < failureRate {
+				reply("451 Temporary failure, try again later")
+				s = session{}
+				continue
+			}
+			id, err := store(s, data)
+			if err != nil {
+				log.Printf("Failed to store a message: %v", err)
+				reply("451 Failed to store the message")
+			} else {
+				reply("250 OK queued as %s", id)
+			}
+			s = session{}
+		case "RSET":
+			s = session{}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// address returns the address of a MAIL FROM:<...> or RCPT TO:<...> argument.
+func address(arg, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		arg = arg[:i]
+	}
+	return strings.Trim(arg, "<>")
+}
+
+// readData reads the message up to the line holding a single dot.
+func readData(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+	tooLarge := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			break
+		}
+		// a leading dot of a line is doubled by the client
+		line = strings.TrimPrefix(line, ".")
+		if len(data)+len(line) > maxMessageSize {
+			tooLarge = true
+			continue
+		}
+		data = append(data, line...)
+	}
+	if tooLarge {
+		return nil, fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+	}
+	return data, nil
+}
+
+// store writes the message to a temporary file and renames it, so the
+// listing never sees a half written one.
+func store(s session, data []byte) (string, error) {
+	id := fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&received, 1))
+	envelope := fmt.Sprintf("X-Envelope-From: %s\r\nX-Envelope-To: %s\r\n", s.from, strings.Join(s.to, ", "))
+
+	path := filepath.Join(dir, id+".eml")
+	if err := ioutil.WriteFile(path+".tmp", append([]byte(envelope), data...), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+	log.Printf("Received %s from %s to %s", id, s.from, strings.Join(s.to, ", "))
+	return id, nil
+}
+
+type messageSummary struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+}
+
+// listMessages answers GET /messages with the stored messages, the latest
+// first, and GET /messages?id=... with the raw message.
+func listMessages(w http.ResponseWriter, req *http.Request) {
+	if id := req.URL.Query().Get("id"); id != "" {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(id)+".eml"))
+		if err != nil {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		_, _ = w.Write(data)
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	summaries := make([]messageSummary, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		m, err := mail.ReadMessage(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			continue
+		}
+		date, _ := m.Header.Date()
+		summaries = append(summaries, messageSummary{
+			ID:      strings.TrimSuffix(filepath.Base(path), ".eml"),
+			From:    m.Header.Get("From"),
+			To:      m.Header.Get("To"),
+			Subject: m.Header.Get("Subject"),
+			Date:    date,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Date.After(summaries[j].Date) })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summaries)
+}
@@ -9,20 +9,27 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	// "go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"github.com/arman-madi/handson-opentelemetry/common"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/global"
 	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
 )
 
 type Fedex struct {
@@ -30,26 +37,21 @@ type Fedex struct {
 	Basket  []string `json:"basket"`
 }
 
-var logger = log.New(os.Stderr, "[fedex] ", log.Ldate|log.Ltime|log.Llongfile)
+var logger = common.NewLogger("fedex")
 
 // Create one tracer per package
 // NOTE: You only need a tracer if you are creating your own spans
 var tracer trace.Tracer
 
-// Initializes an OTLP exporter, and configures the corresponding trace and
-// metric providers.
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
 func initProvider() func() {
 	ctx := context.Background()
 
 	otelAgentAddr := "otel-collector:4317"
 
-	traceClient := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithEndpoint(otelAgentAddr),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()))
-	
-	traceExp, err := otlptrace.New(ctx, traceClient)
-	handleErr(err, "Failed to create the collector trace exporter")
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
 	res, err := resource.New(ctx,
 		resource.WithFromEnv(),
 		resource.WithProcess(),
@@ -61,21 +63,85 @@ func initProvider() func() {
 		),
 	)
 	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
+	)
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
 	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
 	)
 
-	// set global propagator to tracecontext (the default is no-op).
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 	otel.SetTracerProvider(tracerProvider)
 
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
 	return func() {
 		cxt, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
-		if err := traceExp.Shutdown(cxt); err != nil {
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
 			otel.Handle(err)
 		}
 	}
@@ -87,18 +153,32 @@ func handleErr(err error, message string) {
 	}
 }
 
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
 func main() {
 	logger.Println("Hello, this is fedex service which is responsible to ship goods via FedEx in order to demonestrate how OpenTelemetry works!")
 
 	shutdown := initProvider()
 	defer shutdown()
 
+	tracer = otel.Tracer("handson-opentelemetry/fedex")
+
+	shipments, err := common.NewShipmentStore(getenv("SHIPMENTS_FILE", "shipments.json"), newTrackingNumber)
+	handleErr(err, "Failed to load the shipments")
+	clock := common.NewShipmentClock()
+	go common.NewWebhookNotifier("FedEx", shipments, clock).Run()
+
 	fedexHandler := func(w http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
 		span := trace.SpanFromContext(ctx)
 		traceId := span.SpanContext().TraceID().String()
-		logger.Printf("Handle request with trace id: %+v\n", traceId)
+		common.Logf(ctx, common.LevelInfo, "Handle request with trace id: %+v\n", traceId)
 
 		var fedex Fedex
 		err := json.NewDecoder(req.Body).Decode(&fedex)
@@ -107,29 +187,78 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		logger.Printf("New request received: %+v\n", fedex)
+		common.Logf(ctx, common.LevelInfo, "New request received: %+v\n", fedex)
+
+		sh, err := ship(ctx, shipments, fedex)
+		if err != nil {
+			span.AddEvent("Error creating shipment", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			if !common.WriteDeadlineExceeded(w, ctx, err) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"tracking-number\": \"%v\"}\n", traceId, sh.TrackingNumber))
+	}
+
+	shipmentHandler := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		span := trace.SpanFromContext(req.Context())
+		tracking := strings.TrimPrefix(req.URL.Path, "/shipments/")
+		span.SetAttributes(attribute.String("tracking-number", tracking))
 
-		ship(ctx, fedex)
+		sh, err := shipments.Get(tracking)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 
-		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\"}\n", traceId))
+		status := sh.Status("FedEx", clock)
+		span.SetAttributes(attribute.String("shipment-status", status.Status))
+		_ = json.NewEncoder(w).Encode(status)
 	}
 
-	otelHandler := otelhttp.NewHandler(http.HandlerFunc(fedexHandler), "handle-fedex")
+	otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(common.NewIdempotencyStore(), http.HandlerFunc(fedexHandler))), "handle-fedex")
 
 	http.Handle("/", otelHandler)
+	http.Handle("/shipments/", otelhttp.NewHandler(http.HandlerFunc(shipmentHandler), "handle-fedex-shipment"))
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"))
 	logger.Printf("Listening on port 80\n")
-	http.ListenAndServe(":80", nil)
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
 }
 
-func ship(ctx context.Context, fedex Fedex) {
+func ship(ctx context.Context, shipments *common.ShipmentStore, fedex Fedex) (common.Shipment, error) {
 	ctx, span := tracer.Start(ctx, "fedex-ship")
 	defer span.End()
 
 	span.AddEvent("Start shipping with FedEx")
 
-	<-time.After(time.Second * time.Duration(rand.Intn(3)))
+	if err := common.Sleep(ctx, time.Second*time.Duration(rand.Intn(3))); err != nil {
+		return common.Shipment{}, err
+	}
 
-	span.SetAttributes(attribute.StringSlice("Products", fedex.Basket))
+	sh, err := shipments.Create(fedex.Address, fedex.Basket, span.SpanContext(), time.Now())
+	if err != nil {
+		return sh, err
+	}
+
+	span.SetAttributes(
+		attribute.StringSlice("Products", fedex.Basket),
+		attribute.String("tracking-number", sh.TrackingNumber),
+	)
 	span.AddEvent("Successfully shipped with FedEx")
 
+	return sh, nil
+}
+
+// newTrackingNumber returns a 12 digit number as used by FedEx Express.
+func newTrackingNumber() (string, error) {
+	return common.RandomDigits(12)
 }
@@ -0,0 +1,3 @@
+module github.com/arman-madi/handson-opentelemetry/gencerts
+
+go 1.16
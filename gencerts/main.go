@@ -0,0 +1,191 @@
+// Command gencerts creates a local dev CA and a certificate signed by it for
+// every service, so TLS and mTLS can be tried out offline. The certificates
+// are valid as server and as client certificates, for the service name as
+// well as for localhost so the health checks inside the containers pass.
+//
+//	go run ./gencerts -out certs
+//
+// An existing CA in the output directory is reused, so new service
+// certificates can be added without replacing the ones already handed out.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var defaultNames = []string{
+	"back-end",
+	"inventory",
+	"notification",
+	"payment-gateway",
+	"paypal",
+	"credit",
+	"shipping-gateway",
+	"toll",
+	"fedex",
+	"dhl",
+	"otel-collector",
+	"simulator",
+}
+
+func main() {
+	out := flag.String("out", "certs", "directory the certificates are written to")
+	names := flag.String("names", strings.Join(defaultNames, ","), "comma separated names to create a certificate for")
+	validity := flag.Duration("validity", 365*24*time.Hour, "how long the certificates are valid")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	ca, caKey, err := loadCA(*out)
+	if errors.Is(err, os.ErrNotExist) {
+		ca, caKey, err = createCA(*out, *validity)
+	}
+	if err != nil {
+		log.Fatalf("Failed to set up the CA: %v", err)
+	}
+
+	for _, name := range strings.Split(*names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := createCert(*out, name, ca, caKey, *validity); err != nil {
+			log.Fatalf("Failed to create the certificate of %s: %v", name, err)
+		}
+		log.Printf("Created %s\n", filepath.Join(*out, name+".pem"))
+	}
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("invalid PEM in the CA files")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Reusing the CA in %s\n", dir)
+	return cert, key, nil
+}
+
+func createCA(dir string, validity time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "handson-opentelemetry dev CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writePEM(filepath.Join(dir, "ca.pem"), "CERTIFICATE", der, 0o644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(filepath.Join(dir, "ca-key.pem"), key); err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Created the CA %s\n", filepath.Join(dir, "ca.pem"))
+	return cert, key, nil
+}
+
+func createCert(dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der, 0o644); err != nil {
+		return err
+	}
+	return writeKey(filepath.Join(dir, name+"-key.pem"), key)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// readable by everyone on purpose: the containers do not run as the
+	// user who created the files, and these are dev certificates anyway
+	return writePEM(path, "EC PRIVATE KEY", der, 0o644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
@@ -0,0 +1,3 @@
+module github.com/arman-madi/handson-opentelemetry/gentoken
+
+go 1.16
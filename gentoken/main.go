@@ -0,0 +1,155 @@
+// Command gentoken issues JWT bearer tokens for the checkout API. The first
+// run creates an ES256 signing key and the JWKS file back-end verifies the
+// tokens against (JWKS_FILE), later runs reuse them.
+//
+//	go run ./gentoken -dir auth -sub alice -role customer
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", "auth", "directory of the signing key and the JWKS file")
+	sub := flag.String("sub", "alice", "the end-user the token is issued to")
+	role := flag.String("role", "customer", "the role of the end-user")
+	iss := flag.String("iss", "", "the issuer claim, if back-end checks JWT_ISSUER")
+	aud := flag.String("aud", "", "the audience claim, if back-end checks JWT_AUDIENCE")
+	ttl := flag.Duration("ttl", time.Hour, "how long the token is valid")
+	flag.Parse()
+
+	key, err := loadKey(*dir)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = createKey(*dir)
+	}
+	if err != nil {
+		log.Fatalf("Failed to set up the signing key: %v", err)
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub": *sub,
+		"iat": now.Unix(),
+		"exp": now.Add(*ttl).Unix(),
+	}
+	if *role != "" {
+		claims["role"] = *role
+	}
+	if *iss != "" {
+		claims["iss"] = *iss
+	}
+	if *aud != "" {
+		claims["aud"] = *aud
+	}
+
+	token, err := sign(key, claims)
+	if err != nil {
+		log.Fatalf("Failed to sign the token: %v", err)
+	}
+	fmt.Println(token)
+}
+
+func loadKey(dir string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "signing-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM in the signing key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// createKey creates the signing key and publishes it in jwks.json.
+func createKey(dir string) (*ecdsa.PrivateKey, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "signing-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+
+	jwks, err := json.MarshalIndent(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": keyID(key),
+			"kty": "EC",
+			"alg": "ES256",
+			"use": "sig",
+			"crv": "P-256",
+			"x":   encodeCoordinate(key.X),
+			"y":   encodeCoordinate(key.Y),
+		}},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "jwks.json"), jwks, 0o644); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created the signing key and %s\n", filepath.Join(dir, "jwks.json"))
+	return key, nil
+}
+
+func sign(key *ecdsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": keyID(key)})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS wants r and s as fixed size big-endian integers, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// keyID derives the kid from the public key, so it stays the same for the
+// same key.
+func keyID(key *ecdsa.PrivateKey) string {
+	sum := sha256.Sum256(elliptic.Marshal(key.Curve, key.X, key.Y))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+func encodeCoordinate(v *big.Int) string {
+	b := make([]byte, 32)
+	v.FillBytes(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Inventory struct {
+	OrderID       string   `json:"order-id"`
+	Basket        []string `json:"basket"`
+	ReservationID string   `json:"reservation-id"`
+}
+
+var logger = common.NewLogger("inventory")
+
+// Create one tracer per package
+// NOTE: You only need a tracer if you are creating your own spans
+var tracer trace.Tracer
+
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
+func initProvider() func() {
+	ctx := context.Background()
+
+	otelAgentAddr := "otel-collector:4317"
+
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithProcess(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithAttributes(
+			// the service name used to display traces in backends
+			semconv.ServiceNameKey.String("inventory"),
+		),
+	)
+	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
+	)
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
+	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(res),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
+	)
+
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetTracerProvider(tracerProvider)
+
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
+	return func() {
+		cxt, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+	}
+}
+
+func handleErr(err error, message string) {
+	if err != nil {
+		log.Fatalf("%s: %v", message, err)
+	}
+}
+
+func main() {
+	logger.Println("Hello, this is inventory service which is responsible to reserve the stock of the user orders in order to demonestrate how OpenTelemetry works!")
+
+	shutdown := initProvider()
+	defer shutdown()
+
+	tracer = otel.Tracer("handson-opentelemetry/inventory")
+
+	initial, err := strconv.Atoi(getenv("INITIAL_STOCK", "1000"))
+	handleErr(err, "Invalid INITIAL_STOCK")
+	// reservations of checkouts which never finished are released after this
+	ttl, err := time.ParseDuration(getenv("RESERVATION_TTL", "15m"))
+	handleErr(err, "Invalid RESERVATION_TTL")
+	stock, err := newStockStore(getenv("STOCK_FILE", "stock.json"), initial, ttl)
+	handleErr(err, "Failed to load the stock")
+	stock.registerMetrics(global.Meter("inventory-meter"))
+
+	restockInterval, err := time.ParseDuration(getenv("RESTOCK_INTERVAL", "30s"))
+	handleErr(err, "Invalid RESTOCK_INTERVAL")
+	go maintain(stock, restockInterval, initial)
+
+	inventoryHandler := func(phase string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			ctx := req.Context()
+			span := trace.SpanFromContext(ctx)
+			traceId := span.SpanContext().TraceID().String()
+			common.Logf(ctx, common.LevelInfo, "Handle %s request with trace id: %+v\n", phase, traceId)
+
+			var inventory Inventory
+			err := json.NewDecoder(req.Body).Decode(&inventory)
+			if err != nil {
+				span.AddEvent("Error decoding inventory json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			common.Logf(ctx, common.LevelInfo, "New %s request received: %+v\n", phase, inventory)
+
+			var r reservation
+			switch phase {
+			case "reserve":
+				r, err = reserve(ctx, stock, inventory)
+			case "release":
+				r, err = release(ctx, stock, inventory.ReservationID)
+			case "commit":
+				r, err = commit(ctx, stock, inventory.ReservationID)
+			}
+			if err != nil {
+				span.AddEvent(fmt.Sprintf("Error during inventory %s", phase), trace.WithAttributes(attribute.Key("err").String(err.Error())))
+				if !common.WriteDeadlineExceeded(w, ctx, err) {
+					http.Error(w, err.Error(), stockErrorStatus(err))
+				}
+				return
+			}
+
+			_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"reservation-id\": \"%v\", \"state\": \"%v\"}\n", traceId, r.ID, r.State))
+		}
+	}
+
+	idempotencyKeys := common.NewIdempotencyStore()
+	for _, phase := range []string{"reserve", "release", "commit"} {
+		otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(idempotencyKeys, inventoryHandler(phase))), "handle-inventory-"+phase, otelhttp.WithPropagators(otel.GetTextMapPropagator()))
+		http.Handle("/"+phase, otelHandler)
+	}
+
+	stockHandler := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(stock.levels())
+	}
+	http.Handle("/stock", otelhttp.NewHandler(http.HandlerFunc(stockHandler), "handle-stock"))
+
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"))
+	logger.Printf("Listening on port 80\n")
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
+}
+
+func reserve(ctx context.Context, stock *stockStore, inventory Inventory) (reservation, error) {
+	ctx, span := tracer.Start(ctx, "inventory-reserve")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order-id", inventory.OrderID), attribute.Int("items", len(inventory.Basket)))
+	span.AddEvent("Start reserving the basket")
+
+	if err := common.Sleep(ctx, 20*time.Millisecond); err != nil {
+		return reservation{}, err
+	}
+
+	r, err := stock.reserve(inventory.OrderID, inventory.Basket)
+	if err != nil {
+		return r, err
+	}
+
+	span.SetAttributes(attribute.String("reservation-id", r.ID))
+	span.AddEvent("Successfully reserved the basket")
+
+	return r, nil
+}
+
+func release(ctx context.Context, stock *stockStore, id string) (reservation, error) {
+	_, span := tracer.Start(ctx, "inventory-release")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("reservation-id", id))
+	span.AddEvent("Start releasing the reservation")
+
+	r, err := stock.release(id)
+	if err != nil {
+		return r, err
+	}
+
+	span.AddEvent("Successfully released the reservation")
+
+	return r, nil
+}
+
+func commit(ctx context.Context, stock *stockStore, id string) (reservation, error) {
+	_, span := tracer.Start(ctx, "inventory-commit")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("reservation-id", id))
+	span.AddEvent("Start committing the reservation")
+
+	r, err := stock.commit(id)
+	if err != nil {
+		return r, err
+	}
+
+	span.SetAttributes(attribute.String("order-id", r.OrderID))
+	span.AddEvent("Successfully committed the reservation")
+
+	return r, nil
+}
+
+// maintain releases the expired reservations and, unless interval is 0,
+// restocks the items running low every interval.
+func maintain(stock *stockStore, interval time.Duration, level int) {
+	period := interval
+	if period <= 0 {
+		period = time.Minute
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expired, err := stock.expire(now)
+		if err != nil {
+			common.Logf(context.Background(), common.LevelError, "Failed to expire reservations: %v\n", err)
+		}
+		for _, r := range expired {
+			logger.Printf("Reservation %s of order %s expired\n", r.ID, r.OrderID)
+		}
+
+		if interval <= 0 {
+			continue
+		}
+		// below a quarter of the initial stock the items are filled up again
+		restocked, err := stock.restock(level/4, level)
+		if err != nil {
+			common.Logf(context.Background(), common.LevelError, "Failed to restock: %v\n", err)
+		}
+		if len(restocked) > 0 {
+			logger.Printf("Restocked %v\n", restocked)
+		}
+	}
+}
+
+// stockErrorStatus maps stock store errors to HTTP status codes.
+func stockErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errReservationNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errOutOfStock), errors.Is(err, errUnknownItem):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type reservationState string
+
+const (
+	stateReserved  reservationState = "reserved"
+	stateReleased  reservationState = "released"
+	stateCommitted reservationState = "committed"
+	stateExpired   reservationState = "expired"
+)
+
+var (
+	errReservationNotFound = errors.New("reservation not found")
+	errInvalidTransition   = errors.New("invalid reservation state transition")
+	errUnknownItem         = errors.New("unknown item")
+	errOutOfStock          = errors.New("out of stock")
+)
+
+// catalog is what the shop sells, every item is stocked with the initial
+// stock when the service starts without a stock file.
+var catalog = []string{
+	"iPhone 13 pro",
+	"iPhone 13",
+	"iPad Air",
+	"MacBook Pro 14",
+	"AirPods Pro",
+	"Apple Watch 7",
+	"Pixel 6",
+	"Galaxy S21",
+	"Kindle Paperwhite",
+	"PlayStation 5",
+}
+
+// stockLevel is the stock of one item. OnHand is what is in the warehouse,
+// Reserved the part of it held for checkouts which are not done yet.
+type stockLevel struct {
+	Item     string `json:"item"`
+	OnHand   int    `json:"on-hand"`
+	Reserved int    `json:"reserved"`
+}
+
+// available is what can still be reserved.
+func (l stockLevel) available() int {
+	return l.OnHand - l.Reserved
+}
+
+type reservation struct {
+	ID        string           `json:"reservation-id"`
+	OrderID   string           `json:"order-id"`
+	State     reservationState `json:"state"`
+	Items     map[string]int   `json:"items"`
+	CreatedAt time.Time        `json:"created-at"`
+	UpdatedAt time.Time        `json:"updated-at"`
+	ExpiresAt time.Time        `json:"expires-at"`
+}
+
+// stockStore keeps the stock and the reservations in memory and writes them
+// through to a JSON file, so neither is lost on a restart of the service.
+type stockStore struct {
+	mu           sync.Mutex
+	path         string
+	ttl          time.Duration
+	Stock        map[string]*stockLevel  `json:"stock"`
+	Reservations map[string]*reservation `json:"reservations"`
+}
+
+func newStockStore(path string, initial int, ttl time.Duration) (*stockStore, error) {
+	s := &stockStore{
+		path:         path,
+		ttl:          ttl,
+		Stock:        make(map[string]*stockLevel),
+		Reservations: make(map[string]*reservation),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		for _, item := range catalog {
+			s.Stock[item] = &stockLevel{Item: item, OnHand: initial}
+		}
+		return s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// reserve holds the items of basket for an order, all of them or none.
+func (s *stockStore) reserve(orderID string, basket []string) (reservation, error) {
+	items := make(map[string]int)
+	for _, item := range basket {
+		items[item]++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for item, n := range items {
+		l, ok := s.Stock[item]
+		if !ok {
+			return reservation{}, fmt.Errorf("%w: %s", errUnknownItem, item)
+		}
+		if l.available() < n {
+			return reservation{}, fmt.Errorf("%w: %s, %d requested, %d available", errOutOfStock, item, n, l.available())
+		}
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return reservation{}, err
+	}
+
+	now := time.Now().UTC()
+	r := &reservation{
+		ID:        "RES-" + hex.EncodeToString(b),
+		OrderID:   orderID,
+		State:     stateReserved,
+		Items:     items,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	for item, n := range items {
+		s.Stock[item].Reserved += n
+	}
+	s.Reservations[r.ID] = r
+
+	return *r, s.save()
+}
+
+// release gives the items of a reservation back to the available stock.
+func (s *stockStore) release(id string) (reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.finish(id, stateReleased)
+}
+
+// commit takes the items of a reservation out of the stock for good.
+func (s *stockStore) commit(id string) (reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.finish(id, stateCommitted)
+}
+
+// expire releases the reservations whose checkout neither committed nor
+// released them in time, e.g. because the back-end crashed meanwhile.
+func (s *stockStore) expire(now time.Time) ([]reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []reservation
+	for id, r := range s.Reservations {
+		if r.State == stateReserved && now.After(r.ExpiresAt) {
+			r, err := s.finish(id, stateExpired)
+			if err != nil {
+				return expired, err
+			}
+			expired = append(expired, r)
+		}
+	}
+	// the finished reservations are only kept around for a while
+	for id, r := range s.Reservations {
+		if r.State != stateReserved && now.Sub(r.UpdatedAt) > 24*time.Hour {
+			delete(s.Reservations, id)
+		}
+	}
+	return expired, s.save()
+}
+
+// restock fills every item whose available stock fell below threshold up to
+// level again and returns the items it restocked.
+func (s *stockStore) restock(threshold, level int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var restocked []string
+	for _, l := range s.Stock {
+		if l.available() < threshold {
+			l.OnHand = level + l.Reserved
+			restocked = append(restocked, l.Item)
+		}
+	}
+	if len(restocked) == 0 {
+		return nil, nil
+	}
+	sort.Strings(restocked)
+	return restocked, s.save()
+}
+
+// levels returns the stock of every item, ordered by item.
+func (s *stockStore) levels() []stockLevel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	levels := make([]stockLevel, 0, len(s.Stock))
+	for _, l := range s.Stock {
+		levels = append(levels, *l)
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Item < levels[j].Item })
+	return levels
+}
+
+// registerMetrics reports the stock of every item as inventory/stock_on_hand,
+// inventory/stock_reserved and inventory/stock_available.
+func (s *stockStore) registerMetrics(meter metric.Meter) {
+	gauges := []struct {
+		name        string
+		description string
+		value       func(stockLevel) int
+	}{
+		{"inventory/stock_on_hand", "The number of items in the warehouse", func(l stockLevel) int { return l.OnHand }},
+		{"inventory/stock_reserved", "The number of items held for checkouts in flight", func(l stockLevel) int { return l.Reserved }},
+		{"inventory/stock_available", "The number of items which can still be reserved", stockLevel.available},
+	}
+	for _, g := range gauges {
+		value := g.value
+		metric.Must(meter).
+			NewInt64GaugeObserver(
+				g.name,
+				func(_ context.Context, result metric.Int64ObserverResult) {
+					for _, l := range s.levels() {
+						result.Observe(int64(value(l)), attribute.String("item", l.Item))
+					}
+				},
+				metric.WithDescription(g.description),
+			)
+	}
+}
+
+// finish moves a reserved reservation to state to. s.mu must be held.
+func (s *stockStore) finish(id string, to reservationState) (reservation, error) {
+	r, ok := s.Reservations[id]
+	if !ok {
+		return reservation{}, errReservationNotFound
+	}
+	if r.State != stateReserved {
+		return *r, fmt.Errorf("%w: %s -> %s", errInvalidTransition, r.State, to)
+	}
+
+	for item, n := range r.Items {
+		l := s.Stock[item]
+		l.Reserved -= n
+		if to == stateCommitted {
+			l.OnHand -= n
+		}
+	}
+	r.State = to
+	r.UpdatedAt = time.Now().UTC()
+
+	return *r, s.save()
+}
+
+// save writes the whole store to a temporary file and renames it over the
+// previous one, so a crash never leaves a truncated file behind.
+func (s *stockStore) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
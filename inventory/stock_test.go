@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReservationsAreAllOrNothing reserves baskets of which one item is out of
+// stock or not sold at all. Nothing of them may be held, and a basket which
+// fits is held in full.
+func TestReservationsAreAllOrNothing(t *testing.T) {
+	store, err := newStockStore(filepath.Join(t.TempDir(), "stock.json"), 2, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.reserve("ORD-1", []string{"iPad Air", "Pixel 6", "Pixel 6", "Pixel 6"}); !errors.Is(err, errOutOfStock) {
+		t.Errorf("reserving 3 of 2 returned %v, want %v", err, errOutOfStock)
+	}
+	if _, err := store.reserve("ORD-2", []string{"iPad Air", "Nokia 3310"}); !errors.Is(err, errUnknownItem) {
+		t.Errorf("reserving an item which is not sold returned %v, want %v", err, errUnknownItem)
+	}
+	if len(store.Reservations) != 0 || store.Stock["iPad Air"].Reserved != 0 || store.Stock["Pixel 6"].Reserved != 0 {
+		t.Fatalf("the rejected baskets left %d reservations, %d iPad Air and %d Pixel 6 reserved",
+			len(store.Reservations), store.Stock["iPad Air"].Reserved, store.Stock["Pixel 6"].Reserved)
+	}
+
+	r, err := store.reserve("ORD-3", []string{"iPad Air", "Pixel 6", "Pixel 6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != stateReserved || r.Items["iPad Air"] != 1 || r.Items["Pixel 6"] != 2 {
+		t.Errorf("reserve returned %+v, want 1 iPad Air and 2 Pixel 6 reserved", r)
+	}
+	if got := store.Stock["Pixel 6"].available(); got != 0 {
+		t.Errorf("%d Pixel 6 are available after reserving both, want 0", got)
+	}
+	if _, err := store.reserve("ORD-4", []string{"Pixel 6"}); !errors.Is(err, errOutOfStock) {
+		t.Errorf("reserving a reserved item returned %v, want %v", err, errOutOfStock)
+	}
+}
+
+// TestReservationIsReleasedOrCommittedOnce commits one reservation and
+// releases another. A commit takes the items out of the stock, a release gives
+// them back, and neither can be undone or repeated.
+func TestReservationIsReleasedOrCommittedOnce(t *testing.T) {
+	store, err := newStockStore(filepath.Join(t.TempDir(), "stock.json"), 2, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, err := store.reserve("ORD-1", []string{"iPad Air"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.commit(committed.ID); err != nil {
+		t.Fatal(err)
+	}
+	released, err := store.reserve("ORD-2", []string{"iPad Air"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.release(released.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := store.Stock["iPad Air"]; l.OnHand != 1 || l.Reserved != 0 {
+		t.Errorf("the stock is %d on hand and %d reserved, want 1 and 0", l.OnHand, l.Reserved)
+	}
+	for _, id := range []string{committed.ID, released.ID} {
+		if _, err := store.commit(id); !errors.Is(err, errInvalidTransition) {
+			t.Errorf("committing %s again returned %v, want %v", store.Reservations[id].State, err, errInvalidTransition)
+		}
+		if _, err := store.release(id); !errors.Is(err, errInvalidTransition) {
+			t.Errorf("releasing %s again returned %v, want %v", store.Reservations[id].State, err, errInvalidTransition)
+		}
+	}
+	if l := store.Stock["iPad Air"]; l.OnHand != 1 || l.Reserved != 0 {
+		t.Errorf("the rejected changes left %d on hand and %d reserved, want 1 and 0", l.OnHand, l.Reserved)
+	}
+	if _, err := store.release("RES-0123456789abcdef"); !errors.Is(err, errReservationNotFound) {
+		t.Errorf("releasing an unknown reservation returned %v, want %v", err, errReservationNotFound)
+	}
+}
+
+// TestExpiredReservationsGiveTheStockBack leaves a reservation alone past its
+// ttl, as a checkout whose back-end crashed would. It must be released then,
+// not before, and can not be committed any more.
+func TestExpiredReservationsGiveTheStockBack(t *testing.T) {
+	store, err := newStockStore(filepath.Join(t.TempDir(), "stock.json"), 2, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.reserve("ORD-1", []string{"Kindle Paperwhite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := store.expire(r.CreatedAt.Add(10 * time.Minute))
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("expiring within the ttl returned %d reservations, %v, want none", len(expired), err)
+	}
+	expired, err = store.expire(r.CreatedAt.Add(16 * time.Minute))
+	if err != nil || len(expired) != 1 || expired[0].ID != r.ID || expired[0].State != stateExpired {
+		t.Fatalf("expiring past the ttl returned %+v, %v, want the reservation expired", expired, err)
+	}
+	if got := store.Stock["Kindle Paperwhite"].available(); got != 2 {
+		t.Errorf("%d Kindle Paperwhite are available after the expiry, want 2", got)
+	}
+	if _, err := store.commit(r.ID); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("committing an expired reservation returned %v, want %v", err, errInvalidTransition)
+	}
+
+	// the finished reservations are dropped a day after they were finished
+	if _, err := store.expire(time.Now().Add(25 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Reservations[r.ID]; ok {
+		t.Errorf("the expired reservation is still kept a day later")
+	}
+}
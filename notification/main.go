@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Notification asks for an email to the customer about an order. Type picks
+// the template, which uses the rest of the fields.
+type Notification struct {
+	Type           string   `json:"type"`
+	Email          string   `json:"email"`
+	Name           string   `json:"name"`
+	OrderID        string   `json:"order-id"`
+	Items          []string `json:"items"`
+	Carrier        string   `json:"carrier"`
+	TrackingNumber string   `json:"tracking-number"`
+	Status         string   `json:"status"`
+	InvoiceURL     string   `json:"invoice-url"`
+}
+
+var logger = common.NewLogger("notification")
+
+// Create one tracer per package
+// NOTE: You only need a tracer if you are creating your own spans
+var tracer trace.Tracer
+
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
+func initProvider() func() {
+	ctx := context.Background()
+
+	otelAgentAddr := "otel-collector:4317"
+
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithProcess(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithAttributes(
+			// the service name used to display traces in backends
+			semconv.ServiceNameKey.String("notification"),
+		),
+	)
+	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
+	)
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
+	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(res),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
+	)
+
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetTracerProvider(tracerProvider)
+
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
+	return func() {
+		cxt, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+	}
+}
+
+func handleErr(err error, message string) {
+	if err != nil {
+		log.Fatalf("%s: %v", message, err)
+	}
+}
+
+func main() {
+	logger.Println("Hello, this is notification service which is responsible to email the users about their orders in order to demonestrate how OpenTelemetry works!")
+
+	shutdown := initProvider()
+	defer shutdown()
+
+	tracer = otel.Tracer("handson-opentelemetry/notification")
+
+	mailer, err := newMailer(global.Meter("notification-meter"))
+	handleErr(err, "Failed to set up the mailer")
+
+	notifyHandler := func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		traceId := span.SpanContext().TraceID().String()
+		common.Logf(ctx, common.LevelInfo, "Handle notify request with trace id: %+v\n", traceId)
+
+		var notification Notification
+		err := json.NewDecoder(req.Body).Decode(&notification)
+		if err != nil {
+			span.AddEvent("Error decoding notification json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		common.Logf(ctx, common.LevelInfo, "New notify request received: %+v\n", notification)
+
+		msgID, attempts, err := notify(ctx, mailer, notification)
+		if err != nil {
+			span.AddEvent("Error during notify", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			if !common.WriteDeadlineExceeded(w, ctx, err) {
+				http.Error(w, err.Error(), notifyErrorStatus(err))
+			}
+			return
+		}
+
+		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"message-id\": \"%v\", \"attempts\": %d}\n", traceId, msgID, attempts))
+	}
+
+	idempotencyKeys := common.NewIdempotencyStore()
+	otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(idempotencyKeys, http.HandlerFunc(notifyHandler))), "handle-notify", otelhttp.WithPropagators(otel.GetTextMapPropagator()))
+	http.Handle("/notify", otelHandler)
+
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"), smtpDependency(mailer.addr))
+	logger.Printf("Listening on port 80\n")
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
+}
+
+var errInvalidRecipient = errors.New("invalid recipient")
+
+// notify renders the email asked for and delivers it, both in a span of
+// their own.
+func notify(ctx context.Context, mailer *mailer, notification Notification) (string, int, error) {
+	ctx, span := tracer.Start(ctx, "notify-"+notification.Type)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order-id", notification.OrderID), attribute.String("notification.type", notification.Type))
+
+	to, err := mail.ParseAddress(notification.Email)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %v", errInvalidRecipient, err)
+	}
+
+	_, renderSpan := tracer.Start(ctx, "render-email")
+	subject, body, err := render(notification)
+	renderSpan.End()
+	if err != nil {
+		return "", 0, err
+	}
+
+	msgID, attempts, err := mailer.send(ctx, notification.Type, to.Address, subject, body)
+	span.SetAttributes(attribute.String("message-id", msgID), attribute.Int("attempts", attempts))
+	if err != nil {
+		return msgID, attempts, err
+	}
+
+	span.AddEvent("Successfully notified")
+	return msgID, attempts, nil
+}
+
+// notifyErrorStatus maps the errors of a notification to HTTP status codes.
+func notifyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidRecipient), errors.Is(err, errUnknownNotification):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arman-madi/handson-opentelemetry/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sendTimeout bounds one delivery attempt when the request has no deadline.
+const sendTimeout = 30 * time.Second
+
+// mailer delivers emails through the SMTP server at addr. An attempt which
+// failed temporarily, i.e. the connection failed or the server answered with
+// a 4xx code, is retried up to maxAttempts times in total with a random delay
+// of up to baseDelay doubled with every attempt in between.
+type mailer struct {
+	addr        string
+	from        string
+	maxAttempts int
+	baseDelay   time.Duration
+
+	sent     metric.Int64Counter
+	attempts metric.Int64Counter
+	latency  metric.Float64Histogram
+}
+
+// newMailer is configured by SMTP_ADDR, MAIL_FROM, SMTP_MAX_ATTEMPTS (3 by
+// default) and SMTP_RETRY_DELAY (200ms).
+func newMailer(meter metric.Meter) (*mailer, error) {
+	m := &mailer{
+		addr:        getenv("SMTP_ADDR", "localhost:25"),
+		from:        getenv("MAIL_FROM", "shop@handson-opentelemetry.local"),
+		maxAttempts: 3,
+		baseDelay:   200 * time.Millisecond,
+	}
+	if _, _, err := net.SplitHostPort(m.addr); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR: %w", err)
+	}
+	if n, err := strconv.Atoi(getenv("SMTP_MAX_ATTEMPTS", "")); err == nil && n > 0 {
+		m.maxAttempts = n
+	}
+	if d, err := time.ParseDuration(getenv("SMTP_RETRY_DELAY", "")); err == nil && d > 0 {
+		m.baseDelay = d
+	}
+
+	m.sent = metric.Must(meter).
+		NewInt64Counter(
+			"notification/sent",
+			metric.WithDescription("The number of notifications by type and outcome, delivered or failed"),
+		)
+	m.attempts = metric.Must(meter).
+		NewInt64Counter(
+			"notification/send_attempts",
+			metric.WithDescription("The number of attempts to hand a notification to the SMTP server by outcome"),
+		)
+	m.latency = metric.Must(meter).
+		NewFloat64Histogram(
+			"notification/delivery_latency",
+			metric.WithDescription("The time it took to deliver a notification including the retries, in milliseconds"),
+		)
+	return m, nil
+}
+
+// send delivers the email and returns its Message-ID and the number of
+// attempts it took.
+func (m *mailer) send(ctx context.Context, kind, to, subject, body string) (string, int, error) {
+	start := time.Now()
+	msgID, msg := m.compose(ctx, to, subject, body)
+
+	var err error
+	n := 1
+	for ; ; n++ {
+		err = m.attempt(ctx, kind, to, msg, n)
+		if err == nil || n >= m.maxAttempts || !temporary(err) || ctx.Err() != nil {
+			break
+		}
+
+		shift := n - 1
+		if shift > 10 {
+			shift = 10
+		}
+		delay := time.Duration(rand.Int63n(int64(m.baseDelay<<uint(shift)) + 1))
+		trace.SpanFromContext(ctx).AddEvent("Retrying SMTP delivery", trace.WithAttributes(
+			attribute.Int("attempt", n+1),
+			attribute.Int64("delay-ms", delay.Milliseconds()),
+		))
+		if err := common.Sleep(ctx, delay); err != nil {
+			break
+		}
+	}
+
+	outcome := "delivered"
+	if err != nil {
+		outcome = "failed"
+	}
+	labels := []attribute.KeyValue{attribute.String("type", kind), attribute.String("outcome", outcome)}
+	m.sent.Add(ctx, 1, labels...)
+	m.latency.Record(ctx, float64(time.Since(start))/1e6, labels...)
+	return msgID, n, err
+}
+
+// attempt hands the message to the SMTP server once, in a client span of its
+// own.
+func (m *mailer) attempt(ctx context.Context, kind, to string, msg []byte, n int) (err error) {
+	host, port, _ := net.SplitHostPort(m.addr)
+	portNum, _ := strconv.Atoi(port)
+	ctx, span := tracer.Start(ctx, "SMTP send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.NetPeerNameKey.String(host),
+			semconv.NetPeerPortKey.Int(portNum),
+			semconv.PeerServiceKey.String("smtp"),
+			attribute.String("notification.type", kind),
+			attribute.Int("attempt", n),
+		),
+	)
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "permanent-failure"
+			if temporary(err) {
+				outcome = "temporary-failure"
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			var reply *textproto.Error
+			if errors.As(err, &reply) {
+				span.SetAttributes(attribute.Int("smtp.reply_code", reply.Code))
+			}
+		}
+		m.attempts.Add(ctx, 1, attribute.String("type", kind), attribute.String("outcome", outcome))
+		span.End()
+	}()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sendTimeout)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	// net/smtp knows nothing of contexts, the deadline of the connection
+	// bounds the whole conversation instead
+	_ = conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("notification"); err != nil {
+		return err
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// compose builds the message with its headers. The trace id goes along, so a
+// received email can be traced back to the request which sent it.
+func (m *mailer) compose(ctx context.Context, to, subject, body string) (string, []byte) {
+	b := make([]byte, 12)
+	_, _ = crand.Read(b)
+	domain := m.from[strings.LastIndexByte(m.from, '@')+1:]
+	msgID := fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+
+	var msg bytes.Buffer
+	header := func(key, value string) {
+		// no header may smuggle in another one
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, value)
+	}
+	header("From", m.from)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", msgID)
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		header("X-Trace-Id", sc.TraceID().String())
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return msgID, msg.Bytes()
+}
+
+// temporary reports whether a failed attempt is worth another one.
+func temporary(err error) bool {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code >= 400 && reply.Code < 500
+	}
+	// connection errors
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// smtpDependency checks that the SMTP server accepts connections.
+func smtpDependency(addr string) common.Dependency {
+	return common.Dependency{
+		Name: "smtp",
+		Check: func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"text/template"
+)
+
+var errUnknownNotification = errors.New("unknown notification type")
+
+// emailTemplate renders the subject and the plain text body of one type of
+// notification from a Notification.
+type emailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func newEmailTemplate(name, subject, body string) emailTemplate {
+	return emailTemplate{
+		subject: template.Must(template.New(name + "-subject").Parse(subject)),
+		body:    template.Must(template.New(name + "-body").Parse(body)),
+	}
+}
+
+var templates = map[string]emailTemplate{
+	"order-confirmed": newEmailTemplate("order-confirmed",
+		`Your order {{.OrderID}} is confirmed`,
+		`Hello {{.Name}},
+
+thank you for your order {{.OrderID}}. We received your payment and the
+following items are on their way:
+{{range .Items}}
+  * {{.}}
+{{- end}}
+
+{{with .TrackingNumber}}{{$.Carrier}} is going to deliver them, the tracking number is {{.}}.
+{{end}}{{with .InvoiceURL}}Your invoice is available at {{.}}
+{{end}}
+See you soon!
+`),
+	"shipment-update": newEmailTemplate("shipment-update",
+		`Your order {{.OrderID}} is {{.Status}}`,
+		`Hello {{.Name}},
+
+the shipment {{.TrackingNumber}} of your order {{.OrderID}} is {{.Status}} now.
+{{if eq .Status "delivered"}}
+We hope you enjoy it!
+{{else}}
+We let you know as soon as it moves on.
+{{end}}`),
+}
+
+// render returns the subject and body of the email for n.
+func render(n Notification) (string, string, error) {
+	t, ok := templates[n.Type]
+	if !ok {
+		return "", "", fmt.Errorf("%w: %q", errUnknownNotification, n.Type)
+	}
+
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, n); err != nil {
+		return "", "", err
+	}
+	if err := t.body.Execute(&body, n); err != nil {
+		return "", "", err
+	}
+	return subject.String(), body.String(), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+
+// Card is only passed through to the credit provider. It must never be
+// logged as is, String masks everything but the last four digits.
+type Card struct {
+	Number string `json:"number"`
+	Expiry string `json:"expiry"`
+	CVV    string `json:"cvv"`
+}
+
+func (c Card) String() string {
+	last4 := c.Number
+	if len(last4) > 4 {
+		last4 = last4[len(last4)-4:]
+	}
+	return fmt.Sprintf("{last4:%s expiry:%s}", last4, c.Expiry)
+}
+
+// declineMessages maps the decline codes of the providers to the errors shown
+// to the customer. Unknown codes get a generic message.
+var declineMessages = map[string]string{
+	"invalid_number":    "The card number is invalid, please check it and try again.",
+	"unsupported_brand": "This card brand is not accepted, please use another card.",
+	"invalid_expiry":    "The expiry date is invalid, please use the MM/YY format.",
+	"expired_card":      "The card has expired, please use another card.",
+	"invalid_cvv":       "The security code is invalid, please check it and try again.",
+}
+
+func declineMessage(code string) string {
+	if msg, ok := declineMessages[code]; ok {
+		return msg
+	}
+	return "The payment was declined, please use another payment method."
+}
@@ -4,49 +4,106 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"github.com/arman-madi/handson-opentelemetry/common"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
 	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
 )
 
+// Payment is a payment request. The amount is in minor units of the currency,
+// e.g. cents of USD, and is converted to charge-currency when one is given.
 type Payment struct {
-	Name   string `json:"name"`
-	Method string `json:"method"`
-	Amount int    `json:"amount"`
+	Name           string `json:"name"`
+	Method         string `json:"method"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	ChargeCurrency string `json:"charge-currency,omitempty"`
+	TransactionID  string `json:"transaction-id,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	Card           Card   `json:"card"`
 }
 
-var logger = log.New(os.Stderr, "[payment-gateway] ", log.Ldate|log.Ltime|log.Llongfile)
+var errUnknownMethod = errors.New("unknown payment method")
 
-// Initializes an OTLP exporter, and configures the corresponding trace and
-// metric providers.
+// paymentProviders maps the payment methods, in lower case, to the host of
+// their provider. Payments are only ever sent to one of these, and the
+// breakers and metrics only ever see these names.
+var paymentProviders = map[string]string{"paypal": "paypal", "credit": "credit"}
+
+// provider returns the host of the provider of method.
+func provider(method string) (string, error) {
+	if p, ok := paymentProviders[strings.ToLower(method)]; ok {
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: %q", errUnknownMethod, method)
+}
+
+// refundReasons are the reasons of a refund the metrics tell apart, any other
+// is counted as "other" so the free text can not grow their attributes. The
+// span keeps the reason as given.
+var refundReasons = map[string]bool{
+	"requested-by-customer": true,
+	"duplicate":             true,
+	"fraudulent":            true,
+	"damaged":               true,
+	"not-delivered":         true,
+}
+
+func reasonLabel(reason string) string {
+	if refundReasons[reason] {
+		return reason
+	}
+	return "other"
+}
+
+// Transaction is what the payment providers answer to authorize, capture,
+// void and refund requests. The refund fields are only set for the latter.
+type Transaction struct {
+	ID       string `json:"transaction-id"`
+	State    string `json:"state"`
+	RefundID string `json:"refund-id,omitempty"`
+	Amount   int64  `json:"amount,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	Refunded int64  `json:"refunded,omitempty"`
+
+	// set when the provider declined the payment
+	DeclineCode string `json:"decline-code,omitempty"`
+}
+
+var logger = common.NewLogger("payment-gateway")
+
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
 func initProvider() func() {
 	ctx := context.Background()
 
 	otelAgentAddr := "otel-collector:4317"
 
-	traceClient := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithEndpoint(otelAgentAddr),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()))
-	
-	traceExp, err := otlptrace.New(ctx, traceClient)
-	handleErr(err, "Failed to create the collector trace exporter")
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
 	res, err := resource.New(ctx,
 		resource.WithFromEnv(),
 		resource.WithProcess(),
@@ -58,21 +115,85 @@ func initProvider() func() {
 		),
 	)
 	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
+	)
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
 	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
 	)
 
-	// set global propagator to tracecontext (the default is no-op).
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 	otel.SetTracerProvider(tracerProvider)
 
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
 	return func() {
 		cxt, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
-		if err := traceExp.Shutdown(cxt); err != nil {
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
 			otel.Handle(err)
 		}
 	}
@@ -84,65 +205,254 @@ func handleErr(err error, message string) {
 	}
 }
 
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
 func main() {
 	logger.Println("Hello, this is payment-gateway service which is responsible to dispatch user payment requests in order to demonestrate how OpenTelemetry works!")
 
 	flush := initProvider()
 	defer flush()
 
-	paymentHandler := func(w http.ResponseWriter, req *http.Request) {
+	rates, err := loadExchangeRates(getenv("EXCHANGE_RATES_FILE", "rates.json"))
+	handleErr(err, "Failed to load the exchange rates")
+
+	meter := global.Meter("payment-gateway-meter")
+
+	authorizedAmount := metric.Must(meter).
+		NewInt64Counter(
+			"payment/authorized_amount",
+			metric.WithDescription("The total amount authorized by method and currency, in minor units of the currency"),
+		)
+
+	paymentHandler := func(phase string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+
+			ctx := req.Context()
+			span := trace.SpanFromContext(ctx)
+			traceId := span.SpanContext().TraceID().String()
+			common.Logf(ctx, common.LevelInfo, "Handle %s request with trace id: %+v\n", phase, traceId)
+
+			var payment Payment
+			err := json.NewDecoder(req.Body).Decode(&payment)
+			if err != nil {
+				span.AddEvent("Error decoding payment json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			common.Logf(ctx, common.LevelInfo, "New %s request received: %+v\n", phase, payment)
+			if payment.Method, err = provider(payment.Method); err != nil {
+				span.AddEvent("Invalid payment request", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if phase == "authorize" {
+				if payment, err = rates.charge(ctx, payment); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			tx, status, err := send(ctx, phase, payment)
+			if err != nil {
+				if !common.WriteDeadlineExceeded(w, ctx, err) && !common.WriteCircuitOpen(w, err) {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+				}
+				return
+			}
+			if status == http.StatusPaymentRequired {
+				w.WriteHeader(status)
+				_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"decline-code\": \"%v\", \"message\": \"%v\"}\n", traceId, tx.DeclineCode, declineMessage(tx.DeclineCode)))
+				return
+			}
+			if status != http.StatusOK {
+				http.Error(w, fmt.Sprintf("%s %s failed", payment.Method, phase), status)
+				return
+			}
+			if phase == "authorize" {
+				authorizedAmount.Add(ctx, tx.Amount, attribute.String("method", payment.Method), attribute.String("currency", tx.Currency))
+			}
+
+			_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"transaction-id\": \"%v\", \"state\": \"%v\", \"amount\": %d, \"currency\": \"%v\"}\n", traceId, tx.ID, tx.State, tx.Amount, tx.Currency))
+		}
+	}
+
+	idempotencyKeys := common.NewIdempotencyStore()
+	for _, phase := range []string{"authorize", "capture", "void"} {
+		otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(idempotencyKeys, paymentHandler(phase))), "handle-payment-"+phase)
+		http.Handle("/"+phase, otelHandler)
+	}
+
+	refundCount := metric.Must(meter).
+		NewInt64Counter(
+			"payment/refund_counts",
+			metric.WithDescription("The number of refund requests by method, reason, currency and outcome"),
+		)
+	refundAmount := metric.Must(meter).
+		NewInt64Counter(
+			"payment/refund_amount",
+			metric.WithDescription("The total amount refunded by method, reason and currency, in minor units of the currency"),
+		)
+
+	refundsHandler := func(w http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
 		span := trace.SpanFromContext(ctx)
 		traceId := span.SpanContext().TraceID().String()
-		logger.Printf("Handle request with trace id: %+v\n", traceId)
+		common.Logf(ctx, common.LevelInfo, "Handle refund request with trace id: %+v\n", traceId)
 
 		var payment Payment
 		err := json.NewDecoder(req.Body).Decode(&payment)
 		if err != nil {
-			span.AddEvent("Error decoding payment json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			span.AddEvent("Error decoding refund json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		logger.Printf("New request received: %+v\n", payment)
+		common.Logf(ctx, common.LevelInfo, "New refund request received: %+v\n", payment)
 
-		send(ctx, payment)
+		method, methodErr := provider(payment.Method)
+		payment.Method = method
+		if payment.Reason == "" {
+			payment.Reason = "requested-by-customer"
+		}
+		span.SetAttributes(attribute.String("refund.reason", payment.Reason))
+		labels := []attribute.KeyValue{
+			attribute.String("method", payment.Method),
+			attribute.String("reason", reasonLabel(payment.Reason)),
+			attribute.String("currency", payment.Currency),
+		}
 
-		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\"}\n", traceId))
+		// the provider checks the amount and currency against what was
+		// captured, only requests which can never be valid are rejected here
+		_, known := rates.Currencies[payment.Currency]
+		if methodErr != nil || payment.TransactionID == "" || payment.Amount < 0 || (payment.Currency != "" && !known) {
+			span.AddEvent("Invalid refund request")
+			labels[2] = attribute.String("currency", "")
+			refundCount.Add(ctx, 1, append(labels, attribute.String("outcome", "invalid"))...)
+			http.Error(w, "a known method, transaction-id, a non-negative amount and a known currency are required", http.StatusBadRequest)
+			return
+		}
+
+		tx, status, err := send(ctx, "refund", payment)
+		if err != nil {
+			refundCount.Add(ctx, 1, append(labels, attribute.String("outcome", "error"))...)
+			if !common.WriteDeadlineExceeded(w, ctx, err) && !common.WriteCircuitOpen(w, err) {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		if status != http.StatusOK {
+			refundCount.Add(ctx, 1, append(labels, attribute.String("outcome", "rejected"))...)
+			http.Error(w, fmt.Sprintf("%s refund failed", payment.Method), status)
+			return
+		}
+
+		// refunds are in the currency of the transaction, which the request
+		// need not name
+		labels[2] = attribute.String("currency", tx.Currency)
+		refundCount.Add(ctx, 1, append(labels, attribute.String("outcome", "refunded"))...)
+		refundAmount.Add(ctx, tx.Amount, labels...)
+
+		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"transaction-id\": \"%v\", \"state\": \"%v\", \"refund-id\": \"%v\", \"amount\": %d, \"currency\": \"%v\", \"refunded\": %d}\n", traceId, tx.ID, tx.State, tx.RefundID, tx.Amount, tx.Currency, tx.Refunded))
 	}
 
-	otelHandler := otelhttp.NewHandler(http.HandlerFunc(paymentHandler), "handle-payment")
+	http.Handle("/refunds", otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(idempotencyKeys, http.HandlerFunc(refundsHandler))), "handle-refunds"))
+
+	common.Breakers.RegisterMetrics(meter)
 
-	http.Handle("/", otelHandler)
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"), common.ServiceDependency("paypal"), common.ServiceDependency("credit"))
 	logger.Printf("Listening on port 80\n")
-	http.ListenAndServe(":80", nil)
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
 }
 
-func send(ctx context.Context, payment Payment) {
-	client := http.DefaultClient
+var paymentRetries = common.NewRetryPolicy()
 
-	payload := fmt.Sprintf("{\"name\":\"%s\", \"amount\":%d}", payment.Name, payment.Amount)
-	req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/", payment.Method), bytes.NewBuffer([]byte(payload)))
+// send forwards one phase (authorize, capture, void or refund) of a payment to the
+// provider and returns the resulting transaction along with the provider's
+// status code.
+func send(ctx context.Context, phase string, payment Payment) (Transaction, int, error) {
+	// the handlers resolved the method already, a raw one must never end
+	// up as the host the card is sent to
+	host, err := provider(payment.Method)
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+	client := &http.Client{Transport: common.ServiceTLS.Transport}
 
-	_, req = otelhttptrace.W3C(ctx, req)
-	otelhttptrace.Inject(ctx, req,
-		// It seems otelhttptrace.W3C didn't consider global propagator, so you must explecitly inject
-		otelhttptrace.WithPropagators(propagation.TraceContext{}),
-	)
+	// marshalled rather than formatted, a quote in the free-text reason or the
+	// name must not be able to add fields to the request
+	var body interface{} = struct {
+		TransactionID string `json:"transaction-id"`
+	}{payment.TransactionID}
+	switch phase {
+	case "authorize":
+		body = struct {
+			Name     string `json:"name"`
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+			Card     Card   `json:"card"`
+		}{payment.Name, payment.Amount, payment.Currency, payment.Card}
+	case "refund":
+		body = struct {
+			TransactionID string `json:"transaction-id"`
+			Amount        int64  `json:"amount"`
+			Currency      string `json:"currency"`
+			Reason        string `json:"reason"`
+		}{payment.TransactionID, payment.Amount, payment.Currency, payment.Reason}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s://%s/%s", common.ServiceTLS.Scheme(), host, phase), bytes.NewReader(payload))
+	key := common.DerivedIdempotencyKey(ctx, host)
+	if key == "" {
+		// the provider recognises the retries of this call by the key
+		key = common.RandomIdempotencyKey()
+	}
+	req.Header.Set(common.IdempotencyHeader, key)
 
-	logger.Printf("Sending request to %s with headers %+v ...\n", payment.Method, req.Header)
-	res, err := client.Do(req)
+	common.Logf(ctx, common.LevelInfo, "Sending %s request to %s with headers %+v ...\n", phase, payment.Method, req.Header)
+	// one breaker per provider, a failing one does not stop the payments with the others
+	res, err := paymentRetries.Do(ctx, client, host, req)
 
 	span := trace.SpanFromContext(ctx)
 
 	if err != nil {
 		span.AddEvent(fmt.Sprintf("Error sending %s request", payment.Method), trace.WithAttributes(attribute.Key("err").String(err.Error())))
-		return
+		return Transaction{}, 0, err
 	}
+	defer res.Body.Close()
 
-	if res.StatusCode == 200 {
-		span.AddEvent("Successfully paid", trace.WithAttributes(attribute.Key("payment-method").String(payment.Method)))
-	} else {
-		span.AddEvent(fmt.Sprintf("Error paying with %s", payment.Method), trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+	if res.StatusCode == http.StatusPaymentRequired {
+		var tx Transaction
+		_ = json.NewDecoder(res.Body).Decode(&tx)
+		span.AddEvent(fmt.Sprintf("Payment declined by %s", payment.Method), trace.WithAttributes(attribute.Key("decline-code").String(tx.DeclineCode)))
+		return tx, res.StatusCode, nil
 	}
+
+	if res.StatusCode != 200 {
+		span.AddEvent(fmt.Sprintf("Error during %s with %s", phase, payment.Method), trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+		return Transaction{}, res.StatusCode, nil
+	}
+
+	var tx Transaction
+	if err := json.NewDecoder(res.Body).Decode(&tx); err != nil {
+		span.AddEvent(fmt.Sprintf("Error decoding %s response", payment.Method), trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return tx, 0, err
+	}
+
+	span.AddEvent(fmt.Sprintf("Successful %s", phase), trace.WithAttributes(
+		attribute.Key("payment-method").String(payment.Method),
+		attribute.Key("transaction-id").String(tx.ID),
+	))
+	return tx, res.StatusCode, nil
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errUnknownCurrency = errors.New("unknown currency")
+	errAmountTooSmall  = errors.New("amount too small")
+)
+
+// currencyPattern matches ISO 4217 currency codes.
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// currency is one entry of the exchange-rate table. Rate is how many units of
+// the currency one unit of the base currency buys, Exponent the number of its
+// minor units to the unit, e.g. 2 for the cents of USD and 0 for JPY.
+type currency struct {
+	Rate     float64 `json:"rate"`
+	Exponent int     `json:"exponent"`
+}
+
+// exchangeRates is the table payments are converted with, loaded from a JSON
+// file like
+//
+//	{"base": "USD", "currencies": {"USD": {"rate": 1, "exponent": 2}, "EUR": {"rate": 0.92, "exponent": 2}}}
+//
+// Only the currencies of the table are accepted, which also keeps the number
+// of currency attributes of the payment metrics bounded.
+type exchangeRates struct {
+	Base       string              `json:"base"`
+	Currencies map[string]currency `json:"currencies"`
+}
+
+func loadExchangeRates(path string) (*exchangeRates, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r exchangeRates
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	if base, ok := r.Currencies[r.Base]; !ok || base.Rate != 1 {
+		return nil, fmt.Errorf("%s: the base currency %q must be listed with a rate of 1", path, r.Base)
+	}
+	for code, c := range r.Currencies {
+		if !currencyPattern.MatchString(code) {
+			return nil, fmt.Errorf("%s: %q is no ISO 4217 currency code", path, code)
+		}
+		if c.Rate <= 0 || c.Exponent < 0 || c.Exponent > 4 {
+			return nil, fmt.Errorf("%s: invalid rate or exponent of %s", path, code)
+		}
+	}
+	return &r, nil
+}
+
+// convert converts amount minor units of from into minor units of to, rounded
+// half away from zero, and returns the rate it was converted with. An amount
+// which rounds to nothing is rejected, it would be authorized as 0.
+func (r *exchangeRates) convert(amount int64, from, to string) (int64, float64, error) {
+	src, ok := r.Currencies[from]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", errUnknownCurrency, from)
+	}
+	dst, ok := r.Currencies[to]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", errUnknownCurrency, to)
+	}
+
+	rate := dst.Rate / src.Rate
+	major := float64(amount) / math.Pow10(src.Exponent)
+	converted := int64(math.Round(major * rate * math.Pow10(dst.Exponent)))
+	if converted == 0 && amount != 0 {
+		return 0, rate, fmt.Errorf("%w: %d %s is less than half of the smallest unit of %s", errAmountTooSmall, amount, from, to)
+	}
+	return converted, rate, nil
+}
+
+// charge turns the amount of the payment into the one charged in its
+// charge-currency, in a span of its own. Payments without a charge-currency
+// are charged in their currency.
+func (r *exchangeRates) charge(ctx context.Context, payment Payment) (Payment, error) {
+	if _, ok := r.Currencies[payment.Currency]; !ok {
+		return payment, fmt.Errorf("%w: %q", errUnknownCurrency, payment.Currency)
+	}
+	if payment.ChargeCurrency == "" || payment.ChargeCurrency == payment.Currency {
+		return payment, nil
+	}
+
+	_, span := otel.Tracer("payment-gateway").Start(ctx, "convert-currency", trace.WithAttributes(
+		attribute.Int64("amount", payment.Amount),
+		attribute.String("currency", payment.Currency),
+		attribute.String("charge-currency", payment.ChargeCurrency),
+	))
+	defer span.End()
+
+	amount, rate, err := r.convert(payment.Amount, payment.Currency, payment.ChargeCurrency)
+	if err != nil {
+		span.AddEvent("Error converting currency", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return payment, err
+	}
+	span.SetAttributes(attribute.Float64("exchange-rate", rate), attribute.Int64("charge-amount", amount))
+
+	payment.Amount, payment.Currency, payment.ChargeCurrency = amount, payment.ChargeCurrency, ""
+	return payment, nil
+}
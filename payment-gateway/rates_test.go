@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestConversionKeepsTheMinorUnits converts with the table shipped with the
+// service between currencies of 0, 2 and 3 minor units. The amounts must be
+// scaled by the exponents as well as by the rate, and convert back again.
+func TestConversionKeepsTheMinorUnits(t *testing.T) {
+	rates, err := loadExchangeRates("rates.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conversions := []struct {
+		amount   int64
+		from, to string
+		want     int64
+	}{
+		{1234, "USD", "USD", 1234},
+		{1000, "USD", "EUR", 920},
+		{1000, "USD", "JPY", 1495},
+		{1495, "JPY", "USD", 1000},
+		{1000, "USD", "KWD", 3080},
+		{1000, "KWD", "JPY", 485},
+	}
+	for _, c := range conversions {
+		got, _, err := rates.convert(c.amount, c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("converting %d %s to %s returned %d, want %d", c.amount, c.from, c.to, got, c.want)
+		}
+	}
+
+	if _, _, err := rates.convert(1000, "USD", "XAA"); !errors.Is(err, errUnknownCurrency) {
+		t.Errorf("converting to a currency not in the table returned %v, want %v", err, errUnknownCurrency)
+	}
+}
+
+// TestConversionRoundsHalfAwayFromZero converts into a currency worth a tenth
+// of the dollar, so that every half cent lands exactly between two of its
+// minor units. They must be rounded away from zero, not to the even one.
+func TestConversionRoundsHalfAwayFromZero(t *testing.T) {
+	rates := &exchangeRates{Base: "USD", Currencies: map[string]currency{
+		"USD": {Rate: 1, Exponent: 2},
+		"XAA": {Rate: 0.1, Exponent: 2},
+	}}
+
+	for cents, want := range map[int64]int64{5: 1, 15: 2, 25: 3, -5: -1} {
+		got, _, err := rates.convert(cents, "USD", "XAA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("converting %d cents returned %d, want %d", cents, got, want)
+		}
+	}
+}
+
+// TestAmountsBelowTheSmallestUnitAreRejected charges a rial in dollars, which
+// is far less than a cent. It must be rejected rather than authorized as 0,
+// which no provider accepts.
+func TestAmountsBelowTheSmallestUnitAreRejected(t *testing.T) {
+	rates, err := loadExchangeRates("rates.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rates.charge(context.Background(), Payment{Amount: 1, Currency: "IRR", ChargeCurrency: "USD"}); !errors.Is(err, errAmountTooSmall) {
+		t.Errorf("charging a rial in dollars returned %v, want %v", err, errAmountTooSmall)
+	}
+	if got, _, err := rates.convert(0, "IRR", "USD"); err != nil || got != 0 {
+		t.Errorf("converting nothing returned %d, %v, want 0", got, err)
+	}
+}
+
+// TestChargeConvertsIntoTheChargeCurrency charges one payment in yen and
+// another in its own currency. Only the first is converted, and the charged
+// payment carries the currency it is charged in.
+func TestChargeConvertsIntoTheChargeCurrency(t *testing.T) {
+	rates, err := loadExchangeRates("rates.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := rates.charge(context.Background(), Payment{Amount: 1000, Currency: "USD", ChargeCurrency: "JPY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Payment{Amount: 1495, Currency: "JPY"}); got != want {
+		t.Errorf("charge returned %+v, want %+v", got, want)
+	}
+
+	got, err = rates.charge(context.Background(), Payment{Amount: 1000, Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Payment{Amount: 1000, Currency: "EUR"}); got != want {
+		t.Errorf("charge returned %+v, want %+v", got, want)
+	}
+
+	if _, err := rates.charge(context.Background(), Payment{Amount: 1000, Currency: "usd"}); !errors.Is(err, errUnknownCurrency) {
+		t.Errorf("charging a currency not in the table returned %v, want %v", err, errUnknownCurrency)
+	}
+}
+
+// TestBrokenRateTablesAreRejected loads tables a typo could have broken. The
+// service must refuse to start with them rather than convert with them.
+func TestBrokenRateTablesAreRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+
+	for _, table := range []string{
+		`{"base": "USD", "currencies": {"EUR": {"rate": 1, "exponent": 2}}}`,
+		`{"base": "USD", "currencies": {"USD": {"rate": 2, "exponent": 2}}}`,
+		`{"base": "USD", "currencies": {"USD": {"rate": 1, "exponent": 2}, "eur": {"rate": 0.92, "exponent": 2}}}`,
+		`{"base": "USD", "currencies": {"USD": {"rate": 1, "exponent": 2}, "EUR": {"rate": 0, "exponent": 2}}}`,
+		`{"base": "USD", "currencies": {"USD": {"rate": 1, "exponent": 5}}}`,
+		`rates`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(table), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadExchangeRates(path); err == nil {
+			t.Errorf("loading %s succeeded, want an error", table)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,44 +12,48 @@ import (
 	"os"
 	"time"
 
+	"github.com/arman-madi/handson-opentelemetry/common"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/global"
 	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
 )
 
 type Paypal struct {
-	Name   string `json:"name"`
-	Amount int    `json:"amount"`
+	Name          string `json:"name"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	TransactionID string `json:"transaction-id"`
+	Reason        string `json:"reason"`
 }
 
-var logger = log.New(os.Stderr, "[paypal] ", log.Ldate|log.Ltime|log.Llongfile)
+var logger = common.NewLogger("paypal")
 
 // Create one tracer per package
 // NOTE: You only need a tracer if you are creating your own spans
 var tracer trace.Tracer
 
-// Initializes an OTLP exporter, and configures the corresponding trace and
-// metric providers.
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
 func initProvider() func() {
 	ctx := context.Background()
 
 	otelAgentAddr := "otel-collector:4317"
 
-	traceClient := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithEndpoint(otelAgentAddr),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()))
-	
-	traceExp, err := otlptrace.New(ctx, traceClient)
-	handleErr(err, "Failed to create the collector trace exporter")
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
 	res, err := resource.New(ctx,
 		resource.WithFromEnv(),
 		resource.WithProcess(),
@@ -60,21 +65,85 @@ func initProvider() func() {
 		),
 	)
 	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
+	)
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
 	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
 	)
 
-	// set global propagator to tracecontext (the default is no-op).
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 	otel.SetTracerProvider(tracerProvider)
 
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
 	return func() {
 		cxt, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
-		if err := traceExp.Shutdown(cxt); err != nil {
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
 			otel.Handle(err)
 		}
 	}
@@ -94,47 +163,180 @@ func main() {
 
 	tracer = otel.Tracer("handson-opentelemetry/paypal")
 
-	// Register the TraceContext propagator globally.
-	otel.SetTextMapPropagator(propagation.TraceContext{})
 
-	paypalHandler := func(w http.ResponseWriter, req *http.Request) {
-		// _, _, spanCtx := otelhttptrace.Extract(req.Context(), req)
+	transactions, err := common.NewTransactionStore(getenv("TRANSACTIONS_FILE", "transactions.json"), "PAYPAL")
+	handleErr(err, "Failed to load the transactions")
 
-		ctx := req.Context()
-		span := trace.SpanFromContext(ctx)
-		traceId := span.SpanContext().TraceID().String()
-		logger.Printf("Handle request with trace id: %+v\n", traceId)
+	paypalHandler := func(phase string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			// _, _, spanCtx := otelhttptrace.Extract(req.Context(), req)
 
-		var paypal Paypal
-		err := json.NewDecoder(req.Body).Decode(&paypal)
-		if err != nil {
-			span.AddEvent("Error decoding paypal json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		logger.Printf("New request received: %+v\n", paypal)
+			ctx := req.Context()
+			span := trace.SpanFromContext(ctx)
+			traceId := span.SpanContext().TraceID().String()
+			common.Logf(ctx, common.LevelInfo, "Handle %s request with trace id: %+v\n", phase, traceId)
+
+			var paypal Paypal
+			err := json.NewDecoder(req.Body).Decode(&paypal)
+			if err != nil {
+				span.AddEvent("Error decoding paypal json", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			common.Logf(ctx, common.LevelInfo, "New %s request received: %+v\n", phase, paypal)
+
+			var tx common.Transaction
+			var r common.Refund
+			switch phase {
+			case "authorize":
+				tx, err = authorize(ctx, transactions, paypal)
+			case "capture":
+				tx, err = capture(ctx, transactions, paypal.TransactionID)
+			case "void":
+				tx, err = void(ctx, transactions, paypal.TransactionID)
+			case "refund":
+				tx, r, err = refundPayment(ctx, transactions, paypal)
+			}
+			if err != nil {
+				span.AddEvent(fmt.Sprintf("Error during paypal %s", phase), trace.WithAttributes(attribute.Key("err").String(err.Error())))
+				if !common.WriteDeadlineExceeded(w, ctx, err) {
+					http.Error(w, err.Error(), txErrorStatus(err))
+				}
+				return
+			}
 
-		pay(ctx, paypal)
+			if phase == "refund" {
+				_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"transaction-id\": \"%v\", \"state\": \"%v\", \"refund-id\": \"%v\", \"amount\": %d, \"currency\": \"%v\", \"refunded\": %d}\n", traceId, tx.ID, tx.State, r.ID, r.Amount, tx.Currency, tx.Refunded()))
+				return
+			}
 
-		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\"}\n", traceId))
+			_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"transaction-id\": \"%v\", \"state\": \"%v\", \"amount\": %d, \"currency\": \"%v\"}\n", traceId, tx.ID, tx.State, tx.Amount, tx.Currency))
+		}
 	}
 
-	otelHandler := otelhttp.NewHandler(http.HandlerFunc(paypalHandler), "handle-paypal", otelhttp.WithPropagators(propagation.TraceContext{}))
+	idempotencyKeys := common.NewIdempotencyStore()
+	for _, phase := range []string{"authorize", "capture", "void", "refund"} {
+		otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(idempotencyKeys, paypalHandler(phase))), "handle-paypal-"+phase, otelhttp.WithPropagators(otel.GetTextMapPropagator()))
+		http.Handle("/"+phase, otelHandler)
+	}
 
-	http.Handle("/", otelHandler)
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"))
 	logger.Printf("Listening on port 80\n")
-	http.ListenAndServe(":80", nil)
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
 }
 
-func pay(ctx context.Context, paypal Paypal) {
-	ctx, span := tracer.Start(ctx, "paypal-pay")
+func authorize(ctx context.Context, transactions *common.TransactionStore, paypal Paypal) (common.Transaction, error) {
+	ctx, span := tracer.Start(ctx, "paypal-authorize")
 	defer span.End()
 
-	span.AddEvent("Start paying with paypal")
+	span.AddEvent("Start authorizing with paypal")
+	span.SetAttributes(attribute.Int64("amount", paypal.Amount), attribute.String("currency", paypal.Currency))
 
-	<-time.After(time.Second * time.Duration(rand.Intn(3)))
+	if err := common.Sleep(ctx, time.Second*time.Duration(rand.Intn(3))); err != nil {
+		return common.Transaction{}, err
+	}
+
+	tx, err := transactions.Authorize(paypal.Name, paypal.Amount, paypal.Currency, "")
+	if err != nil {
+		return tx, err
+	}
+
+	span.SetAttributes(attribute.String("transaction-id", tx.ID))
+	span.AddEvent("Successfully authorized with paypal")
+
+	return tx, nil
+}
+
+func capture(ctx context.Context, transactions *common.TransactionStore, id string) (common.Transaction, error) {
+	ctx, span := tracer.Start(ctx, "paypal-capture")
+	defer span.End()
 
-	span.SetAttributes(attribute.Int("amount", paypal.Amount))
-	span.AddEvent("Successfully paied with paypal")
+	span.SetAttributes(attribute.String("transaction-id", id))
+	span.AddEvent("Start capturing with paypal")
 
+	if err := common.Sleep(ctx, time.Duration(rand.Intn(300))*time.Millisecond); err != nil {
+		return common.Transaction{}, err
+	}
+
+	tx, err := transactions.Transition(id, common.StateCaptured)
+	if err != nil {
+		return tx, err
+	}
+
+	span.SetAttributes(attribute.Int64("amount", tx.Amount), attribute.String("currency", tx.Currency))
+	span.AddEvent("Successfully captured with paypal")
+
+	return tx, nil
+}
+
+func void(ctx context.Context, transactions *common.TransactionStore, id string) (common.Transaction, error) {
+	ctx, span := tracer.Start(ctx, "paypal-void")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("transaction-id", id))
+	span.AddEvent("Start voiding with paypal")
+
+	tx, err := transactions.Transition(id, common.StateVoided)
+	if err != nil {
+		return tx, err
+	}
+
+	span.AddEvent("Successfully voided with paypal")
+
+	return tx, nil
+}
+
+// refundPayment gives back the requested amount of a captured transaction,
+// or what is left of it when no amount is given.
+func refundPayment(ctx context.Context, transactions *common.TransactionStore, paypal Paypal) (common.Transaction, common.Refund, error) {
+	ctx, span := tracer.Start(ctx, "paypal-refund")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("transaction-id", paypal.TransactionID),
+		attribute.Int64("amount", paypal.Amount),
+		attribute.String("currency", paypal.Currency),
+		attribute.String("reason", paypal.Reason),
+	)
+	span.AddEvent("Start refunding with paypal")
+
+	if err := common.Sleep(ctx, time.Duration(rand.Intn(300))*time.Millisecond); err != nil {
+		return common.Transaction{}, common.Refund{}, err
+	}
+
+	tx, r, err := transactions.Refund(paypal.TransactionID, paypal.Amount, paypal.Currency, paypal.Reason)
+	if err != nil {
+		return tx, r, err
+	}
+
+	span.SetAttributes(attribute.String("refund-id", r.ID), attribute.Int64("refunded", tx.Refunded()))
+	span.AddEvent("Successfully refunded with paypal")
+
+	return tx, r, nil
+}
+
+// txErrorStatus maps transaction store errors to HTTP status codes.
+func txErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, common.ErrTransactionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, common.ErrInvalidTransition):
+		return http.StatusConflict
+	case errors.Is(err, common.ErrInvalidAmount), errors.Is(err, common.ErrInvalidCurrency):
+		return http.StatusBadRequest
+	case errors.Is(err, common.ErrRefundExceeded):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,18 +13,23 @@ import (
 	"strings"
 	"time"
 
-	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"github.com/arman-madi/handson-opentelemetry/common"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/propagation"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
 	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/global"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
 )
 
 type Shipping struct {
@@ -32,22 +38,32 @@ type Shipping struct {
 	Basket  []string `json:"basket"`
 }
 
-var logger = log.New(os.Stderr, "[shipping-gateway] ", log.Ldate|log.Ltime|log.Llongfile)
+var logger = common.NewLogger("shipping-gateway")
 
-// Initializes an OTLP exporter, and configures the corresponding trace and
-// metric providers.
+var errUnknownCarrier = errors.New("unknown carrier")
+
+// carriers maps the shipping vendors, in lower case, to the host of their
+// carrier. Shipments are only ever sent to one of these, and the breakers and
+// metrics only ever see these names.
+var carriers = map[string]string{"toll": "toll", "fedex": "fedex", "dhl": "dhl"}
+
+// carrier returns the host of the carrier of vendor.
+func carrier(vendor string) (string, error) {
+	if c, ok := carriers[strings.ToLower(vendor)]; ok {
+		return c, nil
+	}
+	return "", fmt.Errorf("%w: %q", errUnknownCarrier, vendor)
+}
+
+// Initializes the OTLP exporters, and configures the corresponding trace,
+// metric and log providers.
 func initProvider() func() {
 	ctx := context.Background()
 
 	otelAgentAddr := "otel-collector:4317"
 
-	traceClient := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithEndpoint(otelAgentAddr),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()))
-	
-	traceExp, err := otlptrace.New(ctx, traceClient)
-	handleErr(err, "Failed to create the collector trace exporter")
+	// one resource shared by all three signals so they can be correlated in
+	// the backends
 	res, err := resource.New(ctx,
 		resource.WithFromEnv(),
 		resource.WithProcess(),
@@ -59,21 +75,85 @@ func initProvider() func() {
 		),
 	)
 	handleErr(err, "failed to create resource")
+
+	// none of the exporters wait for the collector, they connect in the
+	// background and retry failed exports with exponential backoff
+	metricClient := otlpmetricgrpc.NewClient(
+		otlpmetricgrpc.WithEndpoint(otelAgentAddr),
+		otlpmetricgrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetrySettings{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	metricExp, err := otlpmetric.New(ctx, common.BufferMetrics(common.MonitoredMetricClient{Client: metricClient}))
+	handleErr(err, "Failed to create the collector metric exporter")
+	pusher := controller.New(
+		processor.NewFactory(
+			simple.NewWithExactDistribution(),
+			metricExp,
+		),
+		controller.WithExporter(metricExp),
+		controller.WithCollectPeriod(2*time.Second),
+		controller.WithResource(res),
+	)
+	global.SetMeterProvider(pusher)
+	err = pusher.Start(ctx)
+	handleErr(err, "Failed to start metric pusher")
+	common.TelemetryHealth.RegisterMetrics(global.Meter("telemetry-meter"))
+
+	traceClient := otlptracegrpc.NewClient(
+		otlptracegrpc.WithEndpoint(otelAgentAddr),
+		otlptracegrpc.WithDialOption(common.CollectorDialOptions()...),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     10 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		}))
+	
+	traceExp, err := otlptrace.New(ctx, common.BufferTraces(common.MonitoredTraceClient{Client: traceClient}))
+	handleErr(err, "Failed to create the collector trace exporter")
 	bsp := sdktrace.NewBatchSpanProcessor(traceExp)
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		// tag every span with the end-user forwarded in the baggage
+		sdktrace.WithSpanProcessor(common.EnduserProcessor{}),
+		// and with what was left of the deadline budget of the request
+		sdktrace.WithSpanProcessor(common.BudgetProcessor{}),
+		// redact personal data before it reaches the exporter
+		sdktrace.WithSpanProcessor(common.NewRedactingProcessor(bsp)),
 	)
 
-	// set global propagator to tracecontext (the default is no-op).
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// set global propagator to tracecontext (the default is no-op), and
+	// baggage which carries the end-user identity from back-end downstream.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 	otel.SetTracerProvider(tracerProvider)
 
+	logExp, err := common.NewLogExporter(ctx, otelAgentAddr, res, common.CollectorDialOptions()...)
+	handleErr(err, "Failed to create the collector log exporter")
+	// keep writing to stderr and also bridge every line into the logs signal
+	logger.SetOutput(common.NewRedactingWriter(io.MultiWriter(os.Stderr, logExp)))
+
 	return func() {
 		cxt, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
-		if err := traceExp.Shutdown(cxt); err != nil {
+		// flushes the spans still queued in the batch span processor before the
+		// exporter is shut down
+		if err := tracerProvider.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		// pushes any last exports to the receiver
+		if err := pusher.Stop(cxt); err != nil {
+			otel.Handle(err)
+		}
+		if err := metricExp.Shutdown(cxt); err != nil {
+			otel.Handle(err)
+		}
+		logger.SetOutput(common.NewRedactingWriter(os.Stderr))
+		if err := logExp.Shutdown(cxt); err != nil {
 			otel.Handle(err)
 		}
 	}
@@ -85,6 +165,13 @@ func handleErr(err error, message string) {
 	}
 }
 
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
 func main() {
 	logger.Println("Hello, this is shipping-gateway service which is responsible to dispatch user shipping requests in order to demonestrate how OpenTelemetry works!")
 
@@ -96,7 +183,7 @@ func main() {
 		ctx := req.Context()
 		span := trace.SpanFromContext(ctx)
 		traceId := span.SpanContext().TraceID().String()
-		logger.Printf("Handle request with trace id: %+v\n", traceId)
+		common.Logf(ctx, common.LevelInfo, "Handle request with trace id: %+v\n", traceId)
 
 		var shipping Shipping
 		err := json.NewDecoder(req.Body).Decode(&shipping)
@@ -105,46 +192,104 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		logger.Printf("New request received: %+v\n", shipping)
+		common.Logf(ctx, common.LevelInfo, "New request received: %+v\n", shipping)
+		if shipping.Vendor, err = carrier(shipping.Vendor); err != nil {
+			span.AddEvent("Invalid shipping request", trace.WithAttributes(attribute.Key("err").String(err.Error())))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		send(ctx, shipping)
+		tracking, err := send(ctx, shipping)
+		if err != nil {
+			if !common.WriteDeadlineExceeded(w, ctx, err) && !common.WriteCircuitOpen(w, err) {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
 
-		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\"}\n", traceId))
+		_, _ = io.WriteString(w, fmt.Sprintf("{\"trace-id\": \"%v\", \"tracking-number\": \"%v\"}\n", traceId, tracking))
 	}
 
-	otelHandler := otelhttp.NewHandler(http.HandlerFunc(shippingHandler), "handle-shipping")
+	otelHandler := otelhttp.NewHandler(common.Budgeted(0, common.Idempotent(common.NewIdempotencyStore(), http.HandlerFunc(shippingHandler))), "handle-shipping")
 
 	http.Handle("/", otelHandler)
+	common.Breakers.RegisterMetrics(global.Meter("shipping-gateway-meter"))
+	common.HandleHealth(http.DefaultServeMux, common.CollectorDependency("otel-collector:4317"), common.ServiceDependency("toll"), common.ServiceDependency("fedex"), common.ServiceDependency("dhl"))
 	logger.Printf("Listening on port 80\n")
-	http.ListenAndServe(":80", nil)
+	srv := &http.Server{Addr: ":80", TLSConfig: common.ServiceTLS.Server}
+	if err := common.Serve(srv); err != nil {
+		logger.Printf("Server stopped: %v\n", err)
+	}
 }
 
-func send(ctx context.Context, shipping Shipping) {
-	client := http.DefaultClient
+var carrierRetries = newCarrierRetryPolicy()
 
-	payload := fmt.Sprintf("{\"address\":\"%s\", \"basket\":[\"%s\"]}", shipping.Address, strings.Join(shipping.Basket, "\",\""))
-	req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/", shipping.Vendor), bytes.NewBuffer([]byte(payload)))
+// newCarrierRetryPolicy hedges the carrier calls which did not answer within
+// CARRIER_HEDGE_DELAY, if it is set.
+func newCarrierRetryPolicy() common.RetryPolicy {
+	p := common.NewRetryPolicy()
+	if d, err := time.ParseDuration(getenv("CARRIER_HEDGE_DELAY", "")); err == nil && d > 0 {
+		p.HedgeDelay = d
+	}
+	return p
+}
 
-	// _, req = otelhttptrace.W3C(ctx, req)
-	otelhttptrace.Inject(ctx, req,
-		// It seems otelhttptrace.W3C didn't consider global propagator, so you must explecitly inject
-		otelhttptrace.WithPropagators(propagation.TraceContext{}),
-	)
+// send hands the shipment over to the carrier and returns its tracking number.
+func send(ctx context.Context, shipping Shipping) (string, error) {
+	// the handler resolved the vendor already, a raw one must never end up
+	// as the host the shipment is sent to
+	host, err := carrier(shipping.Vendor)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Transport: common.ServiceTLS.Transport}
 
-	logger.Printf("Sending request to %s ...\n", shipping.Vendor)
-	res, err := client.Do(req)
+	// marshalled rather than formatted, a quote in the address must not be
+	// able to add fields to the request
+	payload, err := json.Marshal(struct {
+		Address string   `json:"address"`
+		Basket  []string `json:"basket"`
+	}{shipping.Address, shipping.Basket})
+	if err != nil {
+		return "", err
+	}
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s://%s/", common.ServiceTLS.Scheme(), host), bytes.NewReader(payload))
+	key := common.DerivedIdempotencyKey(ctx, host)
+	if key == "" {
+		// the carrier recognises the retries and hedges of this call by the key
+		key = common.RandomIdempotencyKey()
+	}
+	req.Header.Set(common.IdempotencyHeader, key)
+
+	common.Logf(ctx, common.LevelInfo, "Sending request to %s ...\n", shipping.Vendor)
+	// one breaker per carrier, a failing one does not stop the shipments with the others
+	res, err := carrierRetries.Do(ctx, client, host, req)
 
 	span := trace.SpanFromContext(ctx)
 	if err != nil {
 		span.AddEvent(fmt.Sprintf("Error sending %s request", shipping.Vendor), trace.WithAttributes(attribute.Key("err").String(err.Error())))
-		return
+		return "", err
 	}
+	defer res.Body.Close()
 
-	if res.StatusCode == 200 {
-		span.AddEvent("Successfully paid", trace.WithAttributes(attribute.Key("shipping-method").String(shipping.Vendor)))
-	} else {
+	if res.StatusCode != 200 {
 		span.AddEvent(fmt.Sprintf("Error shipping with %s", shipping.Vendor), trace.WithAttributes(attribute.Key("status").Int(res.StatusCode)))
+		return "", fmt.Errorf("shipping with %s failed with status %d", shipping.Vendor, res.StatusCode)
+	}
+
+	var shipment struct {
+		TrackingNumber string `json:"tracking-number"`
 	}
+	if err := json.NewDecoder(res.Body).Decode(&shipment); err != nil {
+		span.AddEvent(fmt.Sprintf("Error decoding %s response", shipping.Vendor), trace.WithAttributes(attribute.Key("err").String(err.Error())))
+		return "", err
+	}
+
+	span.AddEvent("Successfully shipped", trace.WithAttributes(
+		attribute.Key("shipping-method").String(shipping.Vendor),
+		attribute.Key("tracking-number").String(shipment.TrackingNumber),
+	))
+	return shipment.TrackingNumber, nil
 }
 
 // Using otelHttp in the below didn't propagate the right parent-id, so I used the above implementation!.